@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"wire/discovery"
+	"wire/format"
+	"wire/transfer"
+)
+
+//how long a starting daemon has to answer on its control socket
+var DAEMON_START_TIMEOUT = 5 * time.Second
+
+//how long a stopping daemon has to let go of its sessions
+var DAEMON_STOP_TIMEOUT = 10 * time.Second
+
+//how often the link is checked while its missing or in use
+var LINK_RETRY = 5 * time.Second
+
+var CONTROL_TIMEOUT = 5 * time.Second
+
+var ERR_NOT_RUNNING = fmt.Errorf("no daemon running")
+
+func config_dir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "wire")
+}
+
+func state_dir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "wire")
+}
+
+func control_path() string {
+	//one daemon per user, the runtime dir is private and cleared on logout
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "wire.sock")
+	}
+	return filepath.Join(state_dir(), "daemon.sock")
+}
+
+//everything a daemon needs to know, read from key = value lines
+type daemon_config struct {
+	root    string
+	share   bool
+	fsync   bool
+	verbose bool
+
+	//nothing can be asked at a prompt, sessions are only accepted from these or from anyone
+	auto_accept bool
+	trusted     []string
+
+	max_bytes       int64
+	max_files       int64
+	max_total_bytes int64
+	max_total_files int64
+
+	limit       format.ByteSize
+	limit_hours string
+
+	//a file or syslog, stdout when not set
+	log string
+}
+
+func read_config(path string, required bool) (daemon_config, error) {
+	var c daemon_config
+	if home, err := os.UserHomeDir(); err == nil {
+		c.root = filepath.Join(home, "wire")
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) && !required {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return c, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		if err = c.set(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			return c, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return c, err
+	}
+
+	if c.limit_hours != "" && c.limit == 0 {
+		return c, fmt.Errorf("%s: limit-hours needs a limit", path)
+	}
+	return c, nil
+}
+
+func (c *daemon_config) set(key, value string) error {
+	boolean := func(v *bool) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s should be true or false", key)
+		}
+		*v = b
+		return nil
+	}
+	count := func(v *int64) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s should be a count", key)
+		}
+		*v = n
+		return nil
+	}
+	size := func(v *int64) error {
+		n, err := format.ParseBytes(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		*v = n
+		return nil
+	}
+
+	switch key {
+	case "root":
+		c.root = value
+	case "share":
+		return boolean(&c.share)
+	case "fsync":
+		return boolean(&c.fsync)
+	case "verbose":
+		return boolean(&c.verbose)
+	case "auto-accept":
+		return boolean(&c.auto_accept)
+	case "trust":
+		c.trusted = append(c.trusted, split_list(value)...)
+	case "max-bytes":
+		return size(&c.max_bytes)
+	case "max-files":
+		return count(&c.max_files)
+	case "max-total-bytes":
+		return size(&c.max_total_bytes)
+	case "max-total-files":
+		return count(&c.max_total_files)
+	case "limit":
+		if err := c.limit.Set(value); err != nil {
+			return fmt.Errorf("limit: %w", err)
+		}
+	case "limit-hours":
+		if _, err := transfer.ParseSchedule(value); err != nil {
+			return err
+		}
+		c.limit_hours = value
+	case "log":
+		c.log = value
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+//where shown messages go instead of stdout, syslog.Writer is one
+type log_sink interface {
+	Info(m string) error
+	Err(m string) error
+}
+
+type file_log struct {
+	*log.Logger
+}
+
+func (l file_log) Info(m string) error {
+	l.Print(m)
+	return nil
+}
+
+func (l file_log) Err(m string) error {
+	l.Print("error: " + m)
+	return nil
+}
+
+func open_log(target string) (log_sink, error) {
+	if target == "syslog" {
+		return open_syslog()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return file_log{log.New(file, "", log.LstdFlags)}, nil
+}
+
+//answered on the control socket
+type daemon_status struct {
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Root    string    `json:"root"`
+	Log     string    `json:"log"`
+
+	//only set while the receiver is listening, otherwise why it isnt
+	Listening bool   `json:"listening"`
+	Address   string `json:"address"`
+	Error     string `json:"error,omitempty"`
+
+	//finished sessions
+	Sessions int64 `json:"sessions"`
+	Failed   int64 `json:"failed"`
+	Files    int64 `json:"files"`
+	Bytes    int64 `json:"bytes"`
+
+	Active []*daemon_session `json:"active"`
+}
+
+type daemon_session struct {
+	Peer  string `json:"peer"`
+	Files int64  `json:"files"`
+	Size  int64  `json:"size"`
+
+	//bytes so far across the session, and the file being written
+	Done int64  `json:"done"`
+	File string `json:"file"`
+
+	finished int64
+}
+
+type daemon struct {
+	guard  sync.Mutex
+	status daemon_status
+	stop   context.CancelFunc
+}
+
+func (d *daemon) snapshot() daemon_status {
+	d.guard.Lock()
+	defer d.guard.Unlock()
+
+	s := d.status
+	s.Active = make([]*daemon_session, 0, len(d.status.Active))
+	for _, a := range d.status.Active {
+		copied := *a
+		s.Active = append(s.Active, &copied)
+	}
+	return s
+}
+
+func (d *daemon) listening(address string, err error) {
+	d.guard.Lock()
+	defer d.guard.Unlock()
+	d.status.Listening, d.status.Address, d.status.Error = address != "", address, ""
+	if err != nil {
+		d.status.Error = err.Error()
+	}
+}
+
+//the receiver only says its listening by not returning, this tells the status once it is
+type daemon_transport struct {
+	transfer.Transport
+	d *daemon
+}
+
+func (t daemon_transport) Listen(local string) (net.Listener, error) {
+	ln, err := t.Transport.Listen(local)
+	if err == nil {
+		t.d.listening(local, nil)
+	}
+	return ln, err
+}
+
+//keeps the status up to date on the way to the log
+type daemon_events struct {
+	d       *daemon
+	display transfer.Events
+	s       *daemon_session
+}
+
+func (e *daemon_events) SessionStart(s transfer.Session) {
+	e.d.guard.Lock()
+	e.s = &daemon_session{Peer: s.Peer, Files: s.Files, Size: s.Size}
+	e.d.status.Active = append(e.d.status.Active, e.s)
+	e.d.guard.Unlock()
+
+	e.display.SessionStart(s)
+}
+
+func (e *daemon_events) File(t transfer.File) {
+	e.d.guard.Lock()
+	e.s.File = t.Name
+	e.s.Done = e.s.finished + t.Progress
+	e.d.guard.Unlock()
+
+	e.display.File(t)
+}
+
+func (e *daemon_events) FileDone(t transfer.File) {
+	//only what made it to the disk, a file that fails after its last byte doesnt count
+	e.d.guard.Lock()
+	e.s.finished += t.Size
+	e.s.Done = e.s.finished
+	e.d.guard.Unlock()
+
+	e.display.FileDone(t)
+}
+
+func (e *daemon_events) FileError(name string, err error) {
+	e.display.FileError(name, err)
+}
+
+func (e *daemon_events) Reconnecting(attempt, retries int, delay time.Duration, err error) {
+	e.display.Reconnecting(attempt, retries, delay, err)
+}
+
+func (e *daemon_events) SessionDone(r transfer.Summary) {
+	e.d.guard.Lock()
+	active := e.d.status.Active
+	for i, s := range active {
+		if s == e.s {
+			e.d.status.Active = append(active[:i], active[i+1:]...)
+			break
+		}
+	}
+	e.d.status.Sessions++
+	e.d.status.Files += r.Files
+	e.d.status.Bytes += r.Bytes
+	if r.Err != nil {
+		e.d.status.Failed++
+	}
+	e.d.guard.Unlock()
+
+	e.display.SessionDone(r)
+}
+
+func (d *daemon) answer(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT))
+
+	command, _ := bufio.NewReader(conn).ReadString('\n')
+	encoder := json.NewEncoder(conn)
+	switch strings.TrimSpace(command) {
+	case "status":
+		encoder.Encode(d.snapshot())
+	case "stop":
+		show_info("stop requested")
+		encoder.Encode(map[string]bool{"stopping": true})
+		d.stop()
+	default:
+		encoder.Encode(map[string]string{"error": "unknown command"})
+	}
+}
+
+func listen_control() (net.Listener, error) {
+	path := control_path()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	//a daemon that didnt exit cleanly leaves its socket behind
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(path, 0600)
+	return ln, nil
+}
+
+func control(command string, reply interface{}) error {
+	conn, err := net.DialTimeout("unix", control_path(), CONTROL_TIMEOUT)
+	if err != nil {
+		return ERR_NOT_RUNNING
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CONTROL_TIMEOUT))
+
+	if _, err = fmt.Fprintf(conn, "%s\n", command); err != nil {
+		return err
+	}
+	return json.NewDecoder(conn).Decode(reply)
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func run_daemon(ctx context.Context, wireless bool, c daemon_config) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	root, _ := filepath.Abs(c.root)
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		show_error(err, "cant create the receive directory")
+		terminate()
+	}
+
+	d := &daemon{stop: stop}
+	d.status = daemon_status{PID: os.Getpid(), Started: time.Now(), Root: root, Log: c.log, Active: make([]*daemon_session, 0)}
+
+	ln, err := listen_control()
+	if err != nil {
+		show_error(err, "control socket failed")
+		terminate()
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go d.answer(conn)
+		}
+	}()
+
+	//theres nobody to prompt, only auto-accept and trusted peers get in
+	receiver := transfer.Receiver{Root: root, Share: c.share, AutoAccept: c.auto_accept, Trusted: c.trusted, Fsync: c.fsync, Error: show_error, Info: show_info, Verbose: show_verbose}
+	receiver.MaxBytes = c.max_bytes
+	receiver.MaxFiles = c.max_files
+	receiver.MaxTotalBytes = c.max_total_bytes
+	receiver.MaxTotalFiles = c.max_total_files
+	receiver.Limit = setup_limit(ctx, c.limit, c.limit_hours)
+	receiver.Transport = daemon_transport{transfer.TCP{}, d}
+	receiver.Events = func() transfer.Events {
+		return &daemon_events{d: d, display: &plain_display{direction: "from"}}
+	}
+
+	show_info(fmt.Sprintf("daemon receiving into %s, pid %d", root, os.Getpid()))
+	if !c.auto_accept && len(c.trusted) == 0 {
+		show_error(nil, "neither auto-accept nor trust is set, every session will be declined")
+	}
+	//a name is only trusted through what it resolves to, say so now rather than on every declined session
+	for _, peer := range c.trusted {
+		if net.ParseIP(strings.SplitN(peer, "%", 2)[0]) != nil {
+			continue
+		}
+		if _, err := net.LookupHost(peer); err != nil {
+			show_error(nil, fmt.Sprintf("trusted name %s doesnt resolve, sessions from it will be declined", peer))
+		}
+	}
+
+	//the link can come and go, a dongle being unplugged shouldnt need a restart
+	missing := false
+	for ctx.Err() == nil {
+		local, link, err := discovery.FindLinkLocal(wireless)
+		if err != nil {
+			d.listening("", fmt.Errorf("waiting for a link: %w", err))
+			if !missing {
+				show_error(err, "find link-local failed, waiting for a link")
+				missing = true
+			}
+			sleep(ctx, LINK_RETRY)
+			continue
+		}
+		if missing {
+			show_info("link is back")
+			missing = false
+		}
+
+		receiver.Local = local
+		finder := &discovery.Discoverer{Local: local, Interface: link}
+
+		run, cancel := context.WithCancel(ctx)
+		go func() {
+			if err := finder.Respond(run); err != nil && run.Err() == nil {
+				show_error(err, "discovery responder failed")
+				cancel()
+			}
+		}()
+		go func() {
+			for sleep(run, LINK_RETRY) {
+				if now, _, err := discovery.FindLinkLocal(wireless); err != nil || now != local {
+					show_info("link changed, restarting")
+					cancel()
+					return
+				}
+			}
+		}()
+
+		err = receiver.Serve(run)
+		cancel()
+		if err == transfer.ERR_INTERRUPTED {
+			err = nil
+		}
+		d.listening("", err)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			show_error(err, "")
+		}
+		sleep(ctx, LINK_RETRY)
+	}
+
+	show_info("daemon stopped")
+}
+
+func start_daemon(command string, args []string, log_to string) {
+	self, err := os.Executable()
+	if err != nil {
+		show_error(err, "cant find the wire executable")
+		terminate()
+	}
+
+	//the same command again, attached to nothing
+	args = append([]string{command}, args...)
+	args = append(args, "--foreground", "--log", log_to)
+	cmd := exec.Command(self, args...)
+	detach(cmd)
+	if err = cmd.Start(); err != nil {
+		show_error(err, "daemon failed to start")
+		terminate()
+	}
+
+	exited := make(chan bool)
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	deadline := time.Now().Add(DAEMON_START_TIMEOUT)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			show_error(nil, fmt.Sprintf("daemon exited, see %s", log_to))
+			terminate()
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		//answering isnt enough, it has to be listening or have said why not
+		var status daemon_status
+		if err = control("status", &status); err != nil {
+			continue
+		}
+		if status.Listening {
+			show_info(fmt.Sprintf("daemon started, pid %d, receiving into %s on %s, logging to %s", status.PID, status.Root, status.Address, log_to))
+			return
+		}
+		if status.Error != "" {
+			show_error(nil, fmt.Sprintf("daemon started, pid %d, but isnt receiving, retrying every %s: %s", status.PID, LINK_RETRY, status.Error))
+			show_error(nil, fmt.Sprintf("see %s, wire stop stops it", log_to))
+			return
+		}
+	}
+	show_error(nil, fmt.Sprintf("daemon didnt start listening in time, see %s", log_to))
+	terminate()
+}
+
+func daemon_command(ctx context.Context, command string, wireless bool, args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	config := flags.String("config", "", "read settings from this file instead of "+filepath.Join(config_dir(), "daemon.conf"))
+	log_to := flags.String("log", "", "log to this file or to syslog, overrides the config")
+	foreground := flags.Bool("foreground", false, "stay attached, for running under a service manager")
+	flags.Parse(args)
+
+	path, required := *config, true
+	if path == "" {
+		path, required = filepath.Join(config_dir(), "daemon.conf"), false
+	}
+	c, err := read_config(path, required)
+	if err != nil {
+		show_error(err, "cant read the config")
+		terminate()
+	}
+	if *log_to != "" {
+		c.log = *log_to
+	}
+
+	var status daemon_status
+	if control("status", &status) == nil {
+		show_error(nil, fmt.Sprintf("a daemon is already running, pid %d, wire stop stops it", status.PID))
+		terminate()
+	}
+
+	if !*foreground {
+		if c.log == "" {
+			c.log = filepath.Join(state_dir(), "daemon.log")
+		}
+		//once its detached theres nowhere to say the log cant be opened
+		if _, err = open_log(c.log); err != nil {
+			show_error(err, "cant open the log")
+			terminate()
+		}
+		start_daemon(command, args, c.log)
+		return
+	}
+
+	//no terminal to draw on, plain lines to stdout or the log
+	setup_output(false, false, c.verbose)
+	output = OUTPUT_PLAIN
+	colors = false
+	if c.log != "" {
+		if logger, err = open_log(c.log); err != nil {
+			show_error(err, "cant open the log")
+			terminate()
+		}
+	}
+
+	run_daemon(ctx, wireless, c)
+}
+
+func show_status(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	as_json := flags.Bool("json", false, "print the status as json")
+	flags.Parse(args)
+
+	var status daemon_status
+	if err := control("status", &status); err != nil {
+		show_error(err, "")
+		os.Exit(EXIT_FAILED)
+	}
+
+	if *as_json {
+		data, _ := json.MarshalIndent(status, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	show_info(fmt.Sprintf("running since %s, pid %d", status.Started.Format("2006-01-02 15:04:05"), status.PID))
+	if status.Listening {
+		show_info(fmt.Sprintf("receiving into %s on %s", status.Root, status.Address))
+	} else if status.Error != "" {
+		show_error(nil, fmt.Sprintf("not receiving into %s, retrying: %s", status.Root, status.Error))
+	} else {
+		show_info(fmt.Sprintf("not receiving into %s yet", status.Root))
+	}
+	if status.Log != "" {
+		show_info(fmt.Sprintf("logging to %s", status.Log))
+	}
+	show_info(fmt.Sprintf("%s sessions (%s failed), %s files (%s) received", format.Count(status.Sessions), format.Count(status.Failed), format.Count(status.Files), format.Bytes(status.Bytes)))
+	for _, s := range status.Active {
+		progress := 0.0
+		if s.Size != 0 {
+			progress = 100.0 * float64(s.Done) / float64(s.Size)
+		}
+		show_info(fmt.Sprintf("  %s %.1f%% of %s files (%s) %s", s.Peer, progress, format.Count(s.Files), format.Bytes(s.Size), s.File))
+	}
+}
+
+func stop_daemon() {
+	var reply map[string]interface{}
+	if err := control("stop", &reply); err != nil {
+		show_error(err, "")
+		os.Exit(EXIT_FAILED)
+	}
+
+	//the socket goes once the daemon is done with its sessions
+	deadline := time.Now().Add(DAEMON_STOP_TIMEOUT)
+	for time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		if control("status", &reply) == ERR_NOT_RUNNING {
+			show_info("daemon stopped")
+			return
+		}
+	}
+	show_error(nil, "daemon is still running")
+	os.Exit(EXIT_FAILED)
+}
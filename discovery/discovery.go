@@ -1,12 +1,16 @@
-package main
+//finding peers on the local link with ipv6 multicast
+package discovery
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
 	"time"
 
 	"golang.org/x/net/ipv6"
+
+	"wire/protocol"
 )
 
 var DISCOVERY_SEND_PORT = 42070
@@ -14,7 +18,7 @@ var DISCOVERY_RECV_PORT = 42072
 var MULTICAST string = "ff02::1:1001"
 var REQUEST = "REQUEST"
 
-func find_link_local_address(wireless bool) (ip string, i net.Interface, err error) {
+func FindLinkLocal(wireless bool) (ip string, i net.Interface, err error) {
 	//find an interface that looks like ethernet and has an ipv6 link local address
 	ifaces, err := net.Interfaces()
 	if err != nil {
@@ -55,13 +59,12 @@ func find_link_local_address(wireless bool) (ip string, i net.Interface, err err
 	}
 }
 
-func bind_multicast(address string, port int, i net.Interface) (conn *ipv6.PacketConn) {
+func bind_multicast(address string, port int, i net.Interface) (*ipv6.PacketConn, error) {
 	//bind to address:port and join the link-local multicast group
 
 	c, err := net.ListenPacket("udp6", fmt.Sprintf("[%s]:%d", address, port))
 	if err != nil {
-		show_error(err, "listen failed (multicast)")
-		terminate()
+		return nil, fmt.Errorf("listen failed (multicast): %w", err)
 	}
 
 	p := ipv6.NewPacketConn(c)
@@ -71,15 +74,33 @@ func bind_multicast(address string, port int, i net.Interface) (conn *ipv6.Packe
 
 	p.JoinGroup(&i, multicast)
 
-	return p
+	return p, nil
+}
 
+type Discoverer struct {
+	//our link local address and the interface its on
+	Local     string
+	Interface net.Interface
 }
 
-func responder(local string, i net.Interface) {
+func (d *Discoverer) Respond(ctx context.Context) error {
 	//to recieve a multicast we need to bind to the multicast address
 	//to send a multicast we need to bind to the link local address
-	r := bind_multicast(MULTICAST, DISCOVERY_RECV_PORT, i)
-	s := bind_multicast(local, DISCOVERY_SEND_PORT, i)
+	r, err := bind_multicast(MULTICAST, DISCOVERY_RECV_PORT, d.Interface)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	s, err := bind_multicast(d.Local, DISCOVERY_SEND_PORT, d.Interface)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	go func() {
+		<-ctx.Done()
+		r.Close()
+	}()
 
 	data := make([]byte, 64)
 
@@ -87,39 +108,73 @@ func responder(local string, i net.Interface) {
 	destination := &net.UDPAddr{IP: net.ParseIP(MULTICAST), Port: DISCOVERY_RECV_PORT + 1}
 
 	//strip the zone identifier (peer will add their own)
-	local_ip := strings.Split(local, "%")[0]
+	local_ip := strings.Split(d.Local, "%")[0]
+
+	//include our name so peers can pick us out when more than one is responding
+	response := []byte(fmt.Sprintf("%s %s", local_ip, protocol.Hostname()))
 
 	for {
-		r.ReadFrom(data) //blocks until a peer makes a connection
-		s.WriteTo([]byte(local_ip), nil, destination)
+		//blocks until a peer makes a connection
+		if _, _, _, err := r.ReadFrom(data); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		s.WriteTo(response, nil, destination)
 	}
 }
 
-func discover(local string, i net.Interface) (remote string) {
+func (d *Discoverer) Discover(ctx context.Context, name string) (remote string, err error) {
+	//find the first responder, or the first one called name if given
 	//use different ports to the responder so we can recieve and send concurrently
-	r := bind_multicast(MULTICAST, DISCOVERY_RECV_PORT+1, i)
-	s := bind_multicast(local, DISCOVERY_SEND_PORT+1, i)
+	r, err := bind_multicast(MULTICAST, DISCOVERY_RECV_PORT+1, d.Interface)
+	if err != nil {
+		return "", err
+	}
 	defer r.Close()
+	s, err := bind_multicast(d.Local, DISCOVERY_SEND_PORT+1, d.Interface)
+	if err != nil {
+		return "", err
+	}
 	defer s.Close()
 
 	//multicast to our peer who's currently in responder mode
 	destination := &net.UDPAddr{IP: net.ParseIP(MULTICAST), Port: DISCOVERY_RECV_PORT}
 
-	data := make([]byte, 64)
+	data := make([]byte, 256)
+	address := ""
 
 	for {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
 		s.WriteTo([]byte(REQUEST), nil, destination)
 		//keep sending requests every 100 milliseconds until we get a response
 		r.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 		n, _, _, _ := r.ReadFrom(data)
 		if n != 0 {
-			data = data[:n]
-			break
+			peer_address, peer_name, _ := strings.Cut(string(data[:n]), " ")
+			if name == "" || strings.EqualFold(name, peer_name) {
+				address = peer_address
+				break
+			}
 		}
 	}
 
 	//add our interfaces zone identifier since link-local addresses are routable over any interface
-	remote = fmt.Sprintf("%s%%%d", string(data), i.Index)
+	remote = fmt.Sprintf("%s%%%d", address, d.Interface.Index)
+
+	return remote, nil
+}
+
+func (d *Discoverer) Resolve(ctx context.Context, peer string) (remote string, err error) {
+	//peers can be given by address or by name
+	address, _, _ := strings.Cut(peer, "%")
+	if net.ParseIP(address) != nil {
+		return fmt.Sprintf("%s%%%d", address, d.Interface.Index), nil
+	}
 
-	return remote
+	return d.Discover(ctx, peer)
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"wire/format"
+	"wire/transfer"
+)
+
+//newline delimited events for scripts and wrappers
+type json_display struct {
+	s transfer.Session
+
+	//progress is rate limited, a fast link would otherwise flood the output
+	last int64
+}
+
+const (
+	OUTPUT_TERMINAL = iota
+	OUTPUT_PLAIN
+	OUTPUT_JSON
+)
+
+const (
+	VERBOSITY_QUIET = iota
+	VERBOSITY_NORMAL
+	VERBOSITY_VERBOSE
+)
+
+var output = OUTPUT_TERMINAL
+var verbosity = VERBOSITY_NORMAL
+
+func is_terminal(f *os.File) bool {
+	i, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return i.Mode()&os.ModeCharDevice != 0
+}
+
+func setup_output(as_json, quiet, verbose bool) {
+	//escape sequences only make sense on a terminal
+	if !is_terminal(os.Stdout) {
+		output = OUTPUT_PLAIN
+		colors = false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		colors = false
+	}
+	if as_json {
+		output = OUTPUT_JSON
+		colors = false
+	}
+
+	if quiet {
+		verbosity = VERBOSITY_QUIET
+	}
+	if verbose {
+		verbosity = VERBOSITY_VERBOSE
+	}
+
+	//a quiet terminal is just a plain log with nothing in it
+	if verbosity == VERBOSITY_QUIET && output == OUTPUT_TERMINAL {
+		output = OUTPUT_PLAIN
+	}
+}
+
+func new_display(terminal transfer.Events, direction string) transfer.Events {
+	switch output {
+	case OUTPUT_JSON:
+		return &json_display{}
+	case OUTPUT_PLAIN:
+		return &plain_display{direction: direction}
+	default:
+		return terminal
+	}
+}
+
+func show_summary(verb string, r transfer.Summary) {
+	if verbosity >= VERBOSITY_NORMAL {
+		show_info(fmt.Sprintf("%s %s of %s files (%s) in %s, %s/s", verb, format.Count(r.Files), format.Count(r.Total), format.Bytes(r.Bytes), format.Elapsed(r.Elapsed), format.Bytes(int64(r.Rate()))))
+		if r.Filtered != 0 {
+			show_info(fmt.Sprintf("%s entries left out by filters", format.Count(r.Filtered)))
+		}
+	}
+	show_failures("skipped", r.Skipped)
+	show_failures("failed", r.Failed)
+
+	switch {
+	case r.Err == transfer.ERR_SKIPPED:
+		show_error(nil, "nothing sent, use --keep-going to send the rest")
+	case r.Err != nil:
+		show_error(r.Err, "")
+	}
+}
+
+func show_reconnect(prefix string, attempt, retries int, delay time.Duration, err error) {
+	show_info(fmt.Sprintf("%slink lost (%s), reconnecting in %s, attempt %d of %d", prefix, transfer.ErrorMessage(err), format.Elapsed(float64(delay.Milliseconds())), attempt, retries))
+}
+
+func show_failures(title string, failures []transfer.Failure) {
+	if len(failures) == 0 {
+		return
+	}
+
+	show_error(nil, fmt.Sprintf("%s %d:", title, len(failures)))
+	for _, f := range failures {
+		show_error(nil, fmt.Sprintf("  %s: %s", f.Name, transfer.ErrorMessage(f.Err)))
+	}
+}
+
+//one line per event, for logs, pipes and anything else that isnt a terminal
+type plain_display struct {
+	s         transfer.Session
+	direction string
+
+	//progress lines are only written now and then
+	last int64
+}
+
+var PLAIN_PROGRESS_INTERVAL = int64(5 * time.Second)
+
+func (d *plain_display) prefix() string {
+	if d.s.Peer == "" {
+		return ""
+	}
+	return fmt.Sprintf("[%s] ", d.s.Peer)
+}
+
+func (d *plain_display) SessionStart(s transfer.Session) {
+	d.s = s
+	if verbosity >= VERBOSITY_NORMAL {
+		show_info(fmt.Sprintf("%s files (%s) %s %s", format.Count(s.Files), format.Bytes(s.Size), d.direction, s.Peer))
+	}
+}
+
+func (d *plain_display) File(t transfer.File) {
+	now := transfer.Now()
+
+	if t.Progress == t.Resumed {
+		d.last = now
+		if verbosity >= VERBOSITY_VERBOSE {
+			if t.Resumed != 0 {
+				show_info(fmt.Sprintf("%sresume %s (%s) from %s", d.prefix(), t.Name, format.Bytes(t.Size), format.Bytes(t.Resumed)))
+			} else {
+				show_info(fmt.Sprintf("%sstart %s (%s)", d.prefix(), t.Name, format.Bytes(t.Size)))
+			}
+		}
+	}
+
+	if verbosity >= VERBOSITY_VERBOSE && now-d.last >= PLAIN_PROGRESS_INTERVAL {
+		elapsed := float64(now-t.Start) / 1000000.0
+		progress := 100.0 * float64(t.Progress) / float64(t.Size)
+		show_info(fmt.Sprintf("%s%s %.1f%%, %s", d.prefix(), t.Name, progress, format.Speed(t.Progress-t.Resumed, elapsed)))
+		d.last = now
+	}
+}
+
+func (d *plain_display) FileDone(t transfer.File) {
+	if verbosity >= VERBOSITY_NORMAL {
+		elapsed := float64(transfer.Now()-t.Start) / 1000000.0
+		show_info(fmt.Sprintf("%sdone %s (%s) in %s, %s", d.prefix(), t.Name, format.Bytes(t.Size), format.Elapsed(elapsed), format.Speed(t.Size-t.Resumed, elapsed)))
+	}
+}
+
+func (d *plain_display) FileError(name string, err error) {
+	show_error(nil, fmt.Sprintf("%sFAIL %s: %s", d.prefix(), name, transfer.ErrorMessage(err)))
+}
+
+func (d *plain_display) Reconnecting(attempt, retries int, delay time.Duration, err error) {
+	show_reconnect(d.prefix(), attempt, retries, delay, err)
+}
+
+func (d *plain_display) SessionDone(r transfer.Summary) {
+	verb := "received"
+	if d.direction == "to" {
+		verb = "sent"
+	}
+	show_summary(d.prefix()+verb, r)
+}
+
+var json_guard sync.Mutex
+var json_encoder = json.NewEncoder(os.Stdout)
+
+var JSON_PROGRESS_INTERVAL = int64(100 * time.Millisecond)
+
+func emit(event string, fields map[string]interface{}) {
+	fields["event"] = event
+	fields["time"] = time.Now().Format(time.RFC3339Nano)
+
+	json_guard.Lock()
+	defer json_guard.Unlock()
+	json_encoder.Encode(fields)
+}
+
+func (d *json_display) fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	if d.s.Peer != "" {
+		fields["session"] = d.s.ID
+		fields["peer"] = d.s.Peer
+	}
+	return fields
+}
+
+func (d *json_display) SessionStart(s transfer.Session) {
+	d.s = s
+
+	fields := d.fields()
+	fields["files"] = s.Files
+	fields["bytes"] = s.Size
+	emit("session_start", fields)
+}
+
+func (d *json_display) File(t transfer.File) {
+	fields := d.fields()
+	fields["path"] = t.Name
+	fields["size"] = t.Size
+
+	now := transfer.Now()
+
+	if t.Progress == t.Resumed {
+		fields["number"] = t.Number
+		if t.Resumed != 0 {
+			fields["resumed"] = t.Resumed
+		}
+		emit("file_start", fields)
+		d.last = now
+	}
+
+	//the last of it is always reported, file_done can be a while behind
+	if t.Progress != t.Resumed && (t.Progress == t.Size || now-d.last >= JSON_PROGRESS_INTERVAL) {
+		fields["bytes"] = t.Progress
+		emit("progress", fields)
+		d.last = now
+	}
+}
+
+func (d *json_display) FileDone(t transfer.File) {
+	fields := d.fields()
+	fields["path"] = t.Name
+	fields["size"] = t.Size
+	fields["bytes"] = t.Progress
+	fields["elapsed_ms"] = float64(transfer.Now()-t.Start) / 1000000.0
+	emit("file_done", fields)
+}
+
+func (d *json_display) FileError(name string, err error) {
+	fields := d.fields()
+	fields["path"] = name
+	fields["error"] = transfer.ErrorMessage(err)
+	emit("file_error", fields)
+}
+
+func (d *json_display) Reconnecting(attempt, retries int, delay time.Duration, err error) {
+	fields := d.fields()
+	fields["attempt"] = attempt
+	fields["retries"] = retries
+	fields["delay_ms"] = delay.Milliseconds()
+	fields["error"] = transfer.ErrorMessage(err)
+	emit("reconnect", fields)
+}
+
+func failure_fields(failures []transfer.Failure) []map[string]string {
+	out := make([]map[string]string, 0, len(failures))
+	for _, f := range failures {
+		out = append(out, map[string]string{"path": f.Name, "error": transfer.ErrorMessage(f.Err)})
+	}
+	return out
+}
+
+func (d *json_display) SessionDone(r transfer.Summary) {
+	fields := d.fields()
+	fields["files"] = r.Files
+	fields["total"] = r.Total
+	fields["bytes"] = r.Bytes
+	fields["elapsed_ms"] = r.Elapsed
+	fields["rate"] = r.Rate()
+	fields["skipped"] = failure_fields(r.Skipped)
+	fields["failed"] = failure_fields(r.Failed)
+	fields["filtered"] = r.Filtered
+	if r.Err != nil {
+		fields["error"] = r.Err.Error()
+	}
+	emit("session_done", fields)
+}
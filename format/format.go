@@ -0,0 +1,107 @@
+//human readable sizes, counts and durations
+package format
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func Elapsed(ms float64) string {
+	if ms < 1.0 {
+		return fmt.Sprintf("%.3fms", ms)
+	} else if ms < 1000.0 {
+		return fmt.Sprintf("%.1fms", ms)
+	} else if ms < 60000.0 {
+		return fmt.Sprintf("%.3fs", ms/1000.0)
+	} else {
+		return fmt.Sprintf("%.3fm", ms/60000.0)
+	}
+}
+
+func Speed(bytes int64, ms float64) string {
+	if ms <= 0 {
+		return "--/s"
+	}
+	return Bytes(int64(float64(bytes)/(ms/1000.0))) + "/s"
+}
+
+func Duration(seconds float64) string {
+	s := int64(seconds)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, (s/60)%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+func Bytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+
+	size := float64(n)
+	unit := 0
+	for size >= 1000.0 && unit < len(units)-1 {
+		size /= 1000.0
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", n, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
+
+//sizes on the command line, 500M, 2.5G etc
+type ByteSize int64
+
+func (b *ByteSize) String() string {
+	if b == nil || *b == 0 {
+		return "0"
+	}
+	return Bytes(int64(*b))
+}
+
+func (b *ByteSize) Set(value string) error {
+	n, err := ParseBytes(value)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+func ParseBytes(value string) (int64, error) {
+	units := map[string]float64{
+		"": 1, "B": 1,
+		"K": 1e3, "KB": 1e3, "M": 1e6, "MB": 1e6,
+		"G": 1e9, "GB": 1e9, "T": 1e12, "TB": 1e12,
+	}
+
+	value = strings.ToUpper(strings.TrimSpace(value))
+	split := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if split == -1 {
+		split = len(value)
+	}
+
+	n, err := strconv.ParseFloat(value[:split], 64)
+	unit, known := units[strings.TrimSpace(value[split:])]
+	if err != nil || !known || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	return int64(n * unit), nil
+}
+
+func Count(n int64) string {
+	//group digits in thousands, 1204 -> 1,204
+	digits := fmt.Sprintf("%d", n)
+	out := ""
+	for i, c := range digits {
+		if i != 0 && (len(digits)-i)%3 == 0 {
+			out += ","
+		}
+		out += string(c)
+	}
+	return out
+}
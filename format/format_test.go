@@ -0,0 +1,59 @@
+package format
+
+import (
+	"testing"
+)
+
+func TestBytes(t *testing.T) {
+	cases := map[int64]string{
+		0:             "0 B",
+		999:           "999 B",
+		1000:          "1.0 KB",
+		3000000:       "3.0 MB",
+		1500000000000: "1.5 TB",
+	}
+	for n, want := range cases {
+		if got := Bytes(n); got != want {
+			t.Errorf("%d: got %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	cases := map[string]int64{
+		"0":      0,
+		"512":    512,
+		"500M":   500000000,
+		"2.5g":   2500000000,
+		" 1 KB ": 1000,
+	}
+	for value, want := range cases {
+		if got, err := ParseBytes(value); err != nil || got != want {
+			t.Errorf("%q: got %d, %v", value, got, err)
+		}
+	}
+
+	for _, value := range []string{"", "M", "-1", "1Q", "1.2.3"} {
+		if _, err := ParseBytes(value); err == nil {
+			t.Errorf("%q accepted", value)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	cases := map[int64]string{0: "0", 999: "999", 1204: "1,204", 1000000: "1,000,000", -1204: "-1,204"}
+	for n, want := range cases {
+		if got := Count(n); got != want {
+			t.Errorf("%d: got %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	cases := map[float64]string{0: "0:00", 59.9: "0:59", 61: "1:01", 3661: "1:01:01"}
+	for s, want := range cases {
+		if got := Duration(s); got != want {
+			t.Errorf("%v: got %q, want %q", s, got, want)
+		}
+	}
+}
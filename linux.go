@@ -4,13 +4,23 @@
 package main
 
 import (
+	"fmt"
+	"log/syslog"
 	"os"
+	"os/exec"
 	"path/filepath"
-	"time"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
-func get_time() int64 {
-	return time.Now().UnixNano()
+func terminal_width() int {
+	size, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+	if err != nil || size.Col == 0 {
+		return 80
+	}
+	return int(size.Col)
 }
 
 //assume this is in PATH, may not be
@@ -28,13 +38,125 @@ func install_to_local(self string) error {
 
 	file := filepath.Join(home, LOCAL_BIN+"/wire")
 
-	if err = copy_file(self, file); err != nil {
+	if err = os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+
+	//the service may be running the old one, writing over it fails with text file busy
+	//a new file renamed over it leaves the running one alone
+	temp := file + ".new"
+	if err = copy_file(self, temp); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	if err = os.Rename(temp, file); err != nil {
+		os.Remove(temp)
 		return err
 	}
 
 	return nil
 }
 
+func in_path(dir string) bool {
+	for _, p := range filepath.SplitList(os.Getenv("PATH")) {
+		if p != "" && filepath.Clean(p) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+//the daemon as a systemd user service, started with the users session
+var SERVICE_NAME = "wire.service"
+
+//%h is the home folder, the unit doesnt need rewriting if it moves
+var SERVICE_UNIT = `[Unit]
+Description=wire receiver
+
+[Service]
+ExecStart=%h/` + LOCAL_BIN + `/wire daemon --foreground
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=default.target
+`
+
+func service_path() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "systemd/user", SERVICE_NAME), nil
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", append([]string{"--user"}, args...)...).CombinedOutput()
+	if err != nil {
+		//systemctl says why on stderr, the exit status alone says nothing
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func install_service() error {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return fmt.Errorf("systemd isnt available")
+	}
+
+	file, err := service_path()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+	if err = os.WriteFile(file, []byte(SERVICE_UNIT), 0644); err != nil {
+		return err
+	}
+
+	//restart rather than start so a reinstall runs the new binary
+	err = systemctl("daemon-reload")
+	if err == nil {
+		err = systemctl("enable", SERVICE_NAME)
+	}
+	if err == nil {
+		err = systemctl("restart", SERVICE_NAME)
+	}
+	if err != nil {
+		//dont leave a unit behind that nothing has enabled
+		systemctl("disable", SERVICE_NAME)
+		os.Remove(file)
+		systemctl("daemon-reload")
+		return err
+	}
+	return nil
+}
+
+func uninstall_service() error {
+	file, err := service_path()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(file); os.IsNotExist(err) {
+		//installed without --service
+		return nil
+	}
+
+	//the unit goes even if systemd cant be reached, theres nothing left for it to run
+	err = systemctl("disable", "--now", SERVICE_NAME)
+	if remove_err := os.Remove(file); err == nil {
+		err = remove_err
+	}
+	if reload_err := systemctl("daemon-reload"); err == nil {
+		err = reload_err
+	}
+	return err
+}
+
 func uninstall_from_local() error {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -50,16 +172,32 @@ func uninstall_from_local() error {
 	return nil
 }
 
-func install(self string) {
+func install(self string, service bool) {
 	if err := install_to_local(self); err != nil {
 		show_error(err, "failed to install")
 		return
 	}
+	if service {
+		if err := install_service(); err != nil {
+			show_error(err, "failed to set up the service")
+			return
+		}
+	}
 
 	show_info("wire installed")
+	if service {
+		show_info("the daemon runs while youre logged in, loginctl enable-linger keeps it running without")
+	}
+	if home, err := os.UserHomeDir(); err == nil && !in_path(filepath.Join(home, LOCAL_BIN)) {
+		show_error(nil, fmt.Sprintf("%s isnt in PATH, add it to run wire from anywhere", filepath.Join(home, LOCAL_BIN)))
+	}
 }
 
 func uninstall() {
+	//stop it before the binary goes
+	if err := uninstall_service(); err != nil {
+		show_error(err, "failed to remove the service")
+	}
 	if err := uninstall_from_local(); err != nil {
 		show_error(err, "failed to uninstall")
 		return
@@ -67,3 +205,21 @@ func uninstall() {
 
 	show_info("wire uninstalled")
 }
+
+func limit_signals() (slower, faster os.Signal) {
+	//kill -USR1 halves the limit, kill -USR2 doubles it
+	return syscall.SIGUSR1, syscall.SIGUSR2
+}
+
+func detach(cmd *exec.Cmd) {
+	//a session of its own so closing the terminal doesnt take it down
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+func open_syslog() (log_sink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "wire")
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"wire/format"
+	"wire/protocol"
+)
+
+func show_listing(entries []protocol.Entry, as_json bool) {
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Name < entries[b].Name
+	})
+
+	if as_json {
+		type json_entry struct {
+			Name  string    `json:"name"`
+			Type  string    `json:"type"`
+			Size  int64     `json:"size"`
+			Mtime time.Time `json:"mtime"`
+		}
+
+		out := make([]json_entry, 0, len(entries))
+		for _, e := range entries {
+			out = append(out, json_entry{e.Name, protocol.EntryKindName(e.Kind), e.Size, time.Unix(0, e.Mtime)})
+		}
+
+		data, _ := json.MarshalIndent(out, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	for _, e := range entries {
+		size := "-"
+		name := e.Name
+		if e.Kind == protocol.ENTRY_DIR {
+			name += "/"
+		} else {
+			size = format.Bytes(e.Size)
+		}
+		mtime := time.Unix(0, e.Mtime).Format("2006-01-02 15:04")
+
+		fmt.Printf("%-5s %10s  %s  %s\n", protocol.EntryKindName(e.Kind), size, mtime, name)
+	}
+}
@@ -1,12 +1,32 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"wire/discovery"
+	"wire/format"
+	"wire/transfer"
+)
+
+//exit statuses so scripts can tell what happened
+const (
+	EXIT_OK          = 0
+	EXIT_FAILED      = 1
+	EXIT_TIMEOUT     = 2
+	EXIT_INTERRUPTED = 130
 )
 
-var DATA_PORT = 42069
+//how long to look for a receiver that dropped off before trying its last address again
+var REDISCOVER_TIMEOUT = 5 * time.Second
 
 func main() {
 	self := os.Args[0]
@@ -15,7 +35,7 @@ func main() {
 	if len(args) == 0 {
 		//on windows install by just running the binary
 		if runtime.GOOS == "windows" {
-			install(self)
+			install(self, false)
 		} else {
 			help()
 		}
@@ -25,45 +45,350 @@ func main() {
 	command := args[0]
 	paths := args[1:]
 
+	setup_output(false, false, false)
+
 	//should always find an address if theres an ethernet interface with ipv6 enabled (and its up)
 	//unlike ipv4, ipv6 has mandatory link-local address and are stateless (derived from the physical address)
 
 	wireless := false
-	if len(command) == 2 && command[0] == 'w' {
+	if len(command) >= 2 && command[0] == 'w' {
 		wireless = true
-		command = string(command[1])
+		command = command[1:]
 	}
 
-	local, link, err := find_link_local_address(wireless)
-	if err != nil {
-		show_error(err, "find link-local failed")
-		terminate()
+	//only checked by commands that touch the network
+	local, link, link_err := discovery.FindLinkLocal(wireless)
+	require_link := func() {
+		if link_err != nil {
+			show_error(link_err, "find link-local failed")
+			terminate()
+		}
 	}
 
+	//the first ctrl-c winds down cleanly, a second one kills
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	finder := &discovery.Discoverer{Local: local, Interface: link}
+
 	switch command {
 	case "s":
+		sender := transfer.Sender{Local: local}
+		flags := flag.NewFlagSet("s", flag.ExitOnError)
+		flags.BoolVar(&sender.KeepGoing, "keep-going", false, "carry on past files that cant be read")
+		flags.BoolVar(&sender.KeepGoing, "k", false, "shorthand for --keep-going")
+		flags.BoolVar(&sender.Move, "move", false, "remove each file once the receiver has it on disk, then any folders left empty")
+		filter := &transfer.Filter{}
+		var exclude_from repeated
+		flags.Var((*repeated)(&filter.Exclude), "exclude", "leave out files and folders matching this gitignore style pattern, can be repeated")
+		flags.Var((*repeated)(&filter.Include), "include", "only send files matching this pattern, can be repeated")
+		flags.Var(&exclude_from, "exclude-from", "read exclude patterns from this file, one per line")
+		flags.BoolVar(&filter.IgnoreFiles, "gitignore", false, "honour .gitignore and .wireignore files and leave out .git")
+		dry_run := flags.Bool("dry-run", false, "list what would be sent without looking for a peer")
+		files_from := flags.String("files-from", "", "also send every path listed in this file, one per line, - for stdin")
+		nul := flags.Bool("0", false, "paths in --files-from are separated by NUL, as from find -print0")
+		flags.StringVar(&sender.Base, "base", "", "name files by their path relative to this folder")
+		flags.BoolVar(&sender.Flatten, "flatten", false, "name files by their own name only, dropping any folders")
+		flags.StringVar(&sender.Prefix, "prefix", "", "put everything under this folder on the receiver, SRC:DEST does it for one path")
+		flags.IntVar(&sender.Strip, "strip-components", 0, "drop this many leading folders from every name")
+		flags.IntVar(&sender.Retries, "retries", 5, "reconnect this many times in a row when the link drops, 0 gives up straight away")
+		flags.DurationVar(&sender.Backoff, "backoff", time.Second, "wait this long before the first reconnect, doubled each time")
+		as_json, quiet, verbose := output_flags(flags)
+		limit, hours := limit_flags(flags)
+		flags.Parse(paths)
+		paths = flags.Args()
+		setup_output(*as_json, *quiet, *verbose)
+		sender.Limit = setup_limit(ctx, *limit, *hours)
+
+		if *files_from != "" {
+			listed, err := read_paths(*files_from, *nul)
+			if err != nil {
+				show_error(err, "cant read the file list")
+				terminate()
+			}
+			paths = append(paths, listed...)
+		}
+
 		if len(paths) == 0 {
 			show_error(nil, "specify a file or folder")
 			terminate()
 		}
-		remote := discover(local, link)
-		send(paths, local, remote)
+		if sender.Base != "" && sender.Flatten {
+			show_error(nil, "use either --base or --flatten")
+			terminate()
+		}
+		if sender.Strip < 0 {
+			show_error(nil, "--strip-components cant be negative")
+			terminate()
+		}
+
+		for _, path := range exclude_from {
+			patterns, err := transfer.ReadPatterns(path)
+			if err != nil {
+				show_error(err, "cant read exclude patterns")
+				terminate()
+			}
+			filter.Exclude = append(filter.Exclude, patterns...)
+		}
+		sender.Filter = filter
+
+		if *dry_run {
+			plan := sender.Plan(paths)
+			show_plan(plan, *as_json)
+			if len(plan.Skipped) != 0 {
+				os.Exit(EXIT_FAILED)
+			}
+			os.Exit(EXIT_OK)
+		}
+
+		require_link()
+		remote, err := finder.Discover(ctx, "")
+		if err != nil {
+			exit_if_interrupted(ctx)
+			show_error(err, "discovery failed")
+			terminate()
+		}
+		show_verbose(fmt.Sprintf("found peer %s", remote))
+
+		//the link might come back with the receiver somewhere else, look again before reconnecting
+		sender.Redial = func(ctx context.Context, peer string) (string, error) {
+			ctx, cancel := context.WithTimeout(ctx, REDISCOVER_TIMEOUT)
+			defer cancel()
+			return finder.Discover(ctx, peer)
+		}
+		sender.Events = new_display(&send_terminal{}, "to")
+		if err := sender.Send(ctx, remote, paths); err != nil {
+			exit_if_interrupted(ctx)
+			os.Exit(EXIT_FAILED)
+		}
 	case "r":
+		receiver := transfer.Receiver{Local: local, Root: ".", Prompt: prompt, Error: show_error, Info: show_info, Verbose: show_verbose}
+		var max_bytes, max_total_bytes format.ByteSize
+		flags := flag.NewFlagSet("r", flag.ExitOnError)
+		flags.BoolVar(&receiver.Share, "share", false, "allow peers to list the receive directory")
+		flags.BoolVar(&receiver.AutoAccept, "auto-accept", false, "accept every session without asking")
+		trusted := flags.String("trust", "", "comma separated peer names or addresses to accept without asking")
+		flags.Var(&max_bytes, "max-bytes", "reject sessions larger than this, e.g. 500M")
+		flags.Int64Var(&receiver.MaxFiles, "max-files", 0, "reject sessions with more files than this")
+		flags.Var(&max_total_bytes, "max-total-bytes", "stop accepting once this much has been received")
+		flags.Int64Var(&receiver.MaxTotalFiles, "max-total-files", 0, "stop accepting once this many files have been received")
+		flags.BoolVar(&receiver.Fsync, "fsync", false, "flush each file to the disk before acknowledging it")
+		flags.BoolVar(&receiver.Once, "once", false, "exit after the first session")
+		flags.DurationVar(&receiver.ResumeWait, "resume-wait", transfer.RESUME_WAIT, "with --once, wait this long for a sender cut off by the link to reconnect")
+		flags.DurationVar(&receiver.Timeout, "timeout", 0, "exit when nothing has arrived for this long, e.g. 30s")
+		as_json, quiet, verbose := output_flags(flags)
+		limit, hours := limit_flags(flags)
+		flags.Parse(paths)
+		paths = flags.Args()
+		setup_output(*as_json, *quiet, *verbose)
+		receiver.Limit = setup_limit(ctx, *limit, *hours)
+
+		receiver.Trusted = split_list(*trusted)
+		receiver.MaxBytes = int64(max_bytes)
+		receiver.MaxTotalBytes = int64(max_total_bytes)
+		receiver.Events = func() transfer.Events {
+			return new_display(&receive_terminal{}, "from")
+		}
+
 		if len(paths) != 0 {
-			os.Chdir(paths[0])
+			receiver.Root = paths[0]
 		}
 
-		wd, _ := os.Getwd()
+		require_link()
+		root, _ := filepath.Abs(receiver.Root)
 
-		show_info(fmt.Sprintf("receiving into %s...", wd))
+		show_info(fmt.Sprintf("receiving into %s...", root))
 
-		go responder(local, link)
-		receive(local)
+		go func() {
+			if err := finder.Respond(ctx); err != nil && ctx.Err() == nil {
+				show_error(err, "")
+				terminate()
+			}
+		}()
+		err := receiver.Serve(ctx)
+
+		switch {
+		case err == transfer.ERR_INTERRUPTED:
+			exit_if_interrupted(ctx)
+		case err == transfer.ERR_TIMEOUT:
+			show_error(err, "")
+			os.Exit(EXIT_TIMEOUT)
+		case err != nil:
+			show_error(err, "")
+			os.Exit(EXIT_FAILED)
+		}
+		os.Exit(EXIT_OK)
+	case "ls":
+		flags := flag.NewFlagSet("ls", flag.ExitOnError)
+		as_json := flags.Bool("json", false, "print the listing as json")
+		flags.Parse(paths)
+		paths = flags.Args()
+		setup_output(*as_json, false, false)
+
+		target := ""
+		if len(paths) != 0 {
+			target = paths[0]
+		}
+		peer, path := split_peer(target)
+
+		require_link()
+		var remote string
+		var err error
+		if peer == "" {
+			remote, err = finder.Discover(ctx, "")
+		} else {
+			remote, err = finder.Resolve(ctx, peer)
+		}
+		if err != nil {
+			exit_if_interrupted(ctx)
+			show_error(err, "discovery failed")
+			terminate()
+		}
+
+		entries, err := transfer.List(ctx, nil, local, remote, path)
+		if err != nil {
+			exit_if_interrupted(ctx)
+			show_error(err, "listing failed")
+			terminate()
+		}
+		show_listing(entries, *as_json)
+	case "daemon":
+		daemon_command(ctx, args[0], wireless, paths)
+	case "status":
+		show_status(paths)
+	case "stop":
+		stop_daemon()
 	case "i":
-		install(self)
+		flags := flag.NewFlagSet("i", flag.ExitOnError)
+		service := flags.Bool("service", false, "also run the daemon as a systemd user service, linux only")
+		flags.Parse(paths)
+		install(self, *service)
 	case "u":
 		uninstall()
 	case "h":
 		help()
 	}
 }
+
+func split_peer(target string) (peer, path string) {
+	//PEER:PATH, addresses need brackets since they contain colons
+	if strings.HasPrefix(target, "[") {
+		if end := strings.Index(target, "]:"); end != -1 {
+			return target[1:end], target[end+2:]
+		}
+	}
+
+	if peer, path, found := strings.Cut(target, ":"); found {
+		return peer, path
+	}
+
+	return "", target
+}
+
+func read_paths(list string, nul bool) ([]string, error) {
+	if list == "-" {
+		return transfer.ReadPaths(os.Stdin, nul)
+	}
+
+	file, err := os.Open(list)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return transfer.ReadPaths(file, nul)
+}
+
+func split_list(list string) []string {
+	out := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+//a flag that can be given more than once
+type repeated []string
+
+func (r *repeated) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *repeated) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+func output_flags(flags *flag.FlagSet) (as_json, quiet, verbose *bool) {
+	as_json = flags.Bool("json", false, "print newline delimited json events instead of progress")
+	quiet = flags.Bool("quiet", false, "only print errors")
+	verbose = flags.Bool("verbose", false, "print more detail")
+	flags.BoolVar(quiet, "q", false, "shorthand for --quiet")
+	flags.BoolVar(verbose, "v", false, "shorthand for --verbose")
+	return as_json, quiet, verbose
+}
+
+func limit_flags(flags *flag.FlagSet) (limit *format.ByteSize, hours *string) {
+	limit = new(format.ByteSize)
+	flags.Var(limit, "limit", "stay under this many bytes per second, e.g. 2M")
+	hours = flags.String("limit-hours", "", "only limit between these times, e.g. 08:00-18:00 for full speed in the evening")
+	return limit, hours
+}
+
+func setup_limit(ctx context.Context, limit format.ByteSize, hours string) *transfer.Limiter {
+	if limit == 0 {
+		if hours != "" {
+			show_error(nil, "--limit-hours needs a --limit")
+			terminate()
+		}
+		return nil
+	}
+
+	var schedule *transfer.Schedule
+	if hours != "" {
+		var err error
+		if schedule, err = transfer.ParseSchedule(hours); err != nil {
+			show_error(err, "")
+			terminate()
+		}
+	}
+	limiter := transfer.NewLimiter(int64(limit), schedule)
+
+	slower, faster := limit_signals()
+	if slower == nil {
+		return limiter
+	}
+	adjust := make(chan os.Signal, 1)
+	signal.Notify(adjust, slower, faster)
+	go func() {
+		for {
+			select {
+			case s := <-adjust:
+				rate := limiter.Rate()
+				if s == slower && rate > 1 {
+					rate /= 2
+				} else if s == faster {
+					rate *= 2
+				}
+				limiter.SetRate(rate)
+				show_info(fmt.Sprintf("limit now %s/s", format.Bytes(rate)))
+			case <-ctx.Done():
+				signal.Stop(adjust)
+				return
+			}
+		}
+	}()
+	return limiter
+}
+
+func exit_if_interrupted(ctx context.Context) {
+	if ctx.Err() == nil {
+		return
+	}
+	restore_terminal()
+	os.Exit(EXIT_INTERRUPTED)
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func FuzzReadHeader(f *testing.F) {
+	f.Add(Header{KIND_FILE, 10, "dir/file"}.Build())
+	f.Add(Header{KIND_SESSION, 24, "host"}.Build())
+	f.Add(Header{KIND_ERROR, 0, ""}.Build())
+	for size := 0; size <= HEADER_SIZE; size++ {
+		data := make([]byte, 16)
+		binary.BigEndian.PutUint16(data, uint16(size))
+		f.Add(data)
+	}
+	f.Add([]byte{0xff, 0xff, KIND_FILE})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := ReadHeader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		if h.Size < 0 || len(h.Name) > MAX_NAME_LENGTH || h.Kind >= KINDS {
+			t.Fatalf("accepted %+v", h)
+		}
+
+		//whatever was accepted has to survive being sent on
+		again, err := ReadHeader(bytes.NewReader(h.Build()))
+		if err != nil {
+			t.Fatalf("%+v: %v", h, err)
+		}
+		if again != h {
+			t.Fatalf("got %+v, want %+v", again, h)
+		}
+	})
+}
+
+func FuzzParseSession(f *testing.F) {
+	f.Add(Session{Files: 2, Size: 100, Top: []string{"a", "b"}}.Build())
+	f.Add(make([]byte, SESSION_FIXED-1))
+	f.Add(append(make([]byte, SESSION_FIXED), 0xff, 0xff, 'a'))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s, err := ParseSession("peer", data)
+		if err != nil {
+			return
+		}
+		if s.Files < 0 || s.Size < 0 || s.More < 0 {
+			t.Fatalf("accepted %+v", s)
+		}
+	})
+}
+
+func FuzzParseListing(f *testing.F) {
+	f.Add(BuildListing([]Entry{{"a", ENTRY_FILE, 1, 2}, {"dir", ENTRY_DIR, 0, 0}}))
+	f.Add([]byte{0, 5})
+	f.Add(make([]byte, 19))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entries, err := ParseListing(data)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(BuildListing(entries), data) {
+			t.Fatal("listing changed on the way through")
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+)
+
+const (
+	ENTRY_FILE byte = iota
+	ENTRY_DIR
+	ENTRY_LINK
+	ENTRY_OTHER
+)
+
+type Entry struct {
+	Name  string
+	Kind  byte
+	Size  int64
+	Mtime int64
+}
+
+func EntryKind(mode fs.FileMode) byte {
+	switch {
+	case mode.IsRegular():
+		return ENTRY_FILE
+	case mode.IsDir():
+		return ENTRY_DIR
+	case mode&fs.ModeSymlink != 0:
+		return ENTRY_LINK
+	default:
+		return ENTRY_OTHER
+	}
+}
+
+func EntryKindName(kind byte) string {
+	switch kind {
+	case ENTRY_FILE:
+		return "file"
+	case ENTRY_DIR:
+		return "dir"
+	case ENTRY_LINK:
+		return "link"
+	default:
+		return "other"
+	}
+}
+
+func BuildListing(entries []Entry) []byte {
+	listing := make([]byte, 0)
+
+	for _, e := range entries {
+		entry_size := 19 + len(e.Name)
+		data := make([]byte, entry_size)
+
+		binary.BigEndian.PutUint16(data[0:2], (uint16)(entry_size))
+		data[2] = e.Kind
+		binary.BigEndian.PutUint64(data[3:11], (uint64)(e.Size))
+		binary.BigEndian.PutUint64(data[11:19], (uint64)(e.Mtime))
+		copy(data[19:], e.Name[:])
+
+		listing = append(listing, data...)
+	}
+
+	return listing
+}
+
+func ParseListing(listing []byte) ([]Entry, error) {
+	entries := make([]Entry, 0)
+
+	for len(listing) != 0 {
+		if len(listing) < 19 {
+			return nil, fmt.Errorf("listing truncated")
+		}
+		entry_size := int(binary.BigEndian.Uint16(listing[0:2]))
+		if entry_size < 19 || entry_size > len(listing) {
+			return nil, fmt.Errorf("listing malformed")
+		}
+
+		var e Entry
+		e.Kind = listing[2]
+		e.Size = int64(binary.BigEndian.Uint64(listing[3:11]))
+		e.Mtime = int64(binary.BigEndian.Uint64(listing[11:19]))
+		e.Name = string(listing[19:entry_size])
+		entries = append(entries, e)
+
+		listing = listing[entry_size:]
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,206 @@
+//the framing used on the data connection between peers
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+//every message on the data connection starts with a header carrying its kind
+const (
+	KIND_FILE byte = iota
+	KIND_LIST
+	KIND_LISTING
+	KIND_ERROR
+	KIND_SESSION
+	KIND_ACCEPT
+	KIND_REJECT
+	KIND_SKIP
+	KIND_DATA
+	KIND_ABORT
+	KIND_FAILED
+	KIND_CANCEL
+	KIND_ACK
+	KIND_RESUME
+	KIND_OFFSET
+
+	//anything from here on is from a newer or broken peer
+	KINDS
+)
+
+//the fixed part of a header, size, kind and payload size
+const HEADER_SIZE = 11
+
+//long enough for any real path, short enough to never matter in memory
+var MAX_NAME_LENGTH = 4096
+
+//payloads that are read whole, sessions and listings, file data is streamed
+var MAX_PAYLOAD int64 = 64 * 1024 * 1024
+
+type Header struct {
+	Kind byte
+	Size int64
+	Name string
+}
+
+//a header this side wont take, as opposed to the link failing under it
+type HeaderError struct {
+	Header Header
+	Err    error
+
+	//the whole header was read and is what was refused, skipping its payload keeps the stream in step
+	Whole bool
+}
+
+func (e *HeaderError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HeaderError) Unwrap() error {
+	return e.Err
+}
+
+func (h Header) Build() []byte {
+	header_size := HEADER_SIZE + len(h.Name)
+	header := make([]byte, header_size)
+
+	binary.BigEndian.PutUint16(header[0:2], (uint16)(header_size))
+	header[2] = h.Kind
+	binary.BigEndian.PutUint64(header[3:11], (uint64)(h.Size))
+	copy(header[11:], h.Name[:])
+
+	return header
+}
+
+func ReadHeader(reader io.Reader) (Header, error) {
+	var h Header
+
+	var header_size_data []byte = make([]byte, 2)
+	err := ReadBuffer(reader, header_size_data)
+	if err != nil {
+		return h, err
+	}
+
+	//the size comes from the peer, check it before trusting it with a slice
+	header_size := int(binary.BigEndian.Uint16(header_size_data))
+	if header_size < HEADER_SIZE {
+		return h, &HeaderError{h, fmt.Errorf("header too short (%d bytes)", header_size), false}
+	}
+	if header_size-HEADER_SIZE > MAX_NAME_LENGTH {
+		return h, &HeaderError{h, fmt.Errorf("name too long (%d bytes)", header_size-HEADER_SIZE), false}
+	}
+
+	header_data := make([]byte, header_size-2)
+	err = ReadBuffer(reader, header_data)
+	if err != nil {
+		return h, err
+	}
+
+	h.Kind = header_data[0]
+	h.Size = int64(binary.BigEndian.Uint64(header_data[1:9]))
+	h.Name = string(header_data[9:])
+
+	if h.Kind >= KINDS {
+		return h, &HeaderError{h, fmt.Errorf("unknown message kind %d", h.Kind), false}
+	}
+	if h.Size < 0 {
+		return h, &HeaderError{h, fmt.Errorf("invalid size"), false}
+	}
+
+	//a name this side cant write is only that files problem
+	if h.Kind == KIND_FILE || h.Kind == KIND_RESUME {
+		name, err := SanitizeName(h.Name)
+		if err == nil && name == "" {
+			err = fmt.Errorf("empty name")
+		}
+		if err != nil {
+			return h, &HeaderError{h, err, true}
+		}
+		h.Name = name
+	}
+
+	return h, nil
+}
+
+func ReadPayload(reader io.Reader, h Header) ([]byte, error) {
+	if h.Size > MAX_PAYLOAD {
+		return nil, fmt.Errorf("payload too large (%d bytes)", h.Size)
+	}
+	payload := make([]byte, h.Size)
+	if err := ReadBuffer(reader, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func WriteMessage(writer io.Writer, kind byte, name string, payload []byte) error {
+	h := Header{Kind: kind, Name: name, Size: int64(len(payload))}
+	if err := WriteBuffer(writer, h.Build()); err != nil {
+		return err
+	}
+	return WriteBuffer(writer, payload)
+}
+
+func SanitizeName(name string) (string, error) {
+	//names from the wire are always relative to the receiving root
+	//reject anything that could escape it rather than trying to fix it up
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") || strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+
+	parts := make([]string, 0)
+	for _, part := range strings.Split(strings.ReplaceAll(name, "\\", "/"), "/") {
+		switch {
+		case part == "" || part == ".":
+			continue
+		case part == "..":
+			return "", fmt.Errorf("invalid name %q", name)
+		case runtime.GOOS == "windows" && strings.Contains(part, ":"):
+			//drive letters and alternate data streams
+			return "", fmt.Errorf("invalid name %q", name)
+		}
+		parts = append(parts, part)
+	}
+
+	return filepath.Join(parts...), nil
+}
+
+func ReadBuffer(reader io.Reader, buffer []byte) error {
+	total := 0
+	len := len(buffer)
+	for total != len {
+		n, err := reader.Read(buffer[total:])
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	return nil
+}
+
+func WriteBuffer(writer io.Writer, buffer []byte) error {
+	total := 0
+	len := len(buffer)
+	for total != len {
+		n, err := writer.Write(buffer[total:])
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	return nil
+}
+
+func Hostname() string {
+	//the name peers know us by
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "unknown"
+	}
+	return name
+}
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	headers := []Header{
+		{KIND_FILE, 0, "a"},
+		{KIND_FILE, 1 << 40, "dir/sub/file.bin"},
+		{KIND_LIST, 0, ""},
+		{KIND_ERROR, 0, "something went wrong"},
+		{KIND_SESSION, 1234, "host"},
+		{KIND_ACCEPT, 0, "peer"},
+		{KIND_SKIP, 0, strings.Repeat("x", 1000)},
+	}
+
+	for _, h := range headers {
+		var buffer bytes.Buffer
+		buffer.Write(h.Build())
+
+		got, err := ReadHeader(&buffer)
+		if err != nil {
+			t.Errorf("%+v: %v", h, err)
+			continue
+		}
+		if h.Kind == KIND_FILE {
+			h.Name = filepath.FromSlash(h.Name)
+		}
+		if got != h {
+			t.Errorf("got %+v, want %+v", got, h)
+		}
+		if buffer.Len() != 0 {
+			t.Errorf("%+v: %d bytes left over", h, buffer.Len())
+		}
+	}
+}
+
+func TestReadHeaderTruncated(t *testing.T) {
+	data := Header{KIND_FILE, 10, "name"}.Build()
+	for n := 0; n < len(data); n++ {
+		if _, err := ReadHeader(bytes.NewReader(data[:n])); err == nil {
+			t.Errorf("%d of %d bytes: no error", n, len(data))
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	good := map[string]string{
+		"a":         "a",
+		"a/b":       filepath.Join("a", "b"),
+		"./a//b/":   filepath.Join("a", "b"),
+		"a\\b":      filepath.Join("a", "b"),
+		"a/./b/..c": filepath.Join("a", "b", "..c"),
+	}
+	for name, want := range good {
+		if got, err := SanitizeName(name); err != nil || got != want {
+			t.Errorf("%q: got %q, %v", name, got, err)
+		}
+	}
+
+	bad := []string{"/etc/passwd", "\\x", "..", "a/../../b", "a/.."}
+	if runtime.GOOS == "windows" {
+		bad = append(bad, "c:/x", "a:stream")
+	}
+	for _, name := range bad {
+		if got, err := SanitizeName(name); err == nil {
+			t.Errorf("%q: accepted as %q", name, got)
+		}
+	}
+}
+
+func TestFileNamesSanitized(t *testing.T) {
+	for _, name := range []string{"../escape", "/abs", "", "."} {
+		data := Header{KIND_FILE, 0, name}.Build()
+		if _, err := ReadHeader(bytes.NewReader(data)); err == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := WriteMessage(&buffer, KIND_LISTING, "dir", []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := ReadHeader(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := ReadPayload(&buffer, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Kind != KIND_LISTING || h.Name != "dir" || string(payload) != "payload" {
+		t.Fatalf("got %+v %q", h, payload)
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	sent := Session{Name: "host", Files: 3, Size: 1 << 33, More: 2, Top: []string{"a", "bb", ""}, Durable: true, Token: [16]byte{1, 2, 3}}
+
+	got, err := ParseSession(sent.Name, sent.Build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, sent) {
+		t.Fatalf("got %+v, want %+v", got, sent)
+	}
+
+	payload := sent.Build()
+	for n := 0; n < len(payload); n++ {
+		if n == SESSION_FIXED || n == SESSION_FIXED+3 || n == SESSION_FIXED+7 {
+			//whole names, a shorter list is still valid
+			continue
+		}
+		if _, err := ParseSession("host", payload[:n]); err == nil {
+			t.Errorf("%d of %d bytes: no error", n, len(payload))
+		}
+	}
+}
+
+func TestListingRoundTrip(t *testing.T) {
+	sent := []Entry{
+		{"file", ENTRY_FILE, 10, 1000},
+		{"dir", ENTRY_DIR, 0, -5},
+		{"", ENTRY_OTHER, 1 << 50, 0},
+	}
+
+	got, err := ParseListing(BuildListing(sent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, sent) {
+		t.Fatalf("got %+v, want %+v", got, sent)
+	}
+
+	listing := BuildListing(sent)
+	if _, err := ParseListing(listing[:len(listing)-1]); err == nil {
+		t.Fatal("truncated listing parsed")
+	}
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+//bits in the flags word of a session
+const (
+	//every file must be on the disk, not just written, before its acknowledged
+	SESSION_DURABLE uint64 = 1 << iota
+)
+
+//counts, flags, token, then the top-level names
+const SESSION_FIXED = 48
+
+//what a sender announces before sending anything
+type Session struct {
+	Name    string
+	Files   int64
+	Size    int64
+	Top     []string
+	More    int64
+	Durable bool
+
+	//the same for every attempt at one send, so a reconnect can be recognised
+	Token [16]byte
+}
+
+func (s Session) Build() []byte {
+	var flags uint64
+	if s.Durable {
+		flags |= SESSION_DURABLE
+	}
+
+	payload := make([]byte, SESSION_FIXED)
+	binary.BigEndian.PutUint64(payload[0:8], (uint64)(s.Files))
+	binary.BigEndian.PutUint64(payload[8:16], (uint64)(s.Size))
+	binary.BigEndian.PutUint64(payload[16:24], (uint64)(s.More))
+	binary.BigEndian.PutUint64(payload[24:32], flags)
+	copy(payload[32:48], s.Token[:])
+
+	for _, name := range s.Top {
+		data := make([]byte, 2+len(name))
+		binary.BigEndian.PutUint16(data[0:2], (uint16)(len(name)))
+		copy(data[2:], name[:])
+		payload = append(payload, data...)
+	}
+
+	return payload
+}
+
+func ParseSession(name string, payload []byte) (Session, error) {
+	var s Session
+	s.Name = name
+
+	if len(payload) < SESSION_FIXED {
+		return s, fmt.Errorf("session truncated")
+	}
+	s.Files = int64(binary.BigEndian.Uint64(payload[0:8]))
+	s.Size = int64(binary.BigEndian.Uint64(payload[8:16]))
+	s.More = int64(binary.BigEndian.Uint64(payload[16:24]))
+	//bits from a newer peer are ignored
+	flags := binary.BigEndian.Uint64(payload[24:32])
+	s.Durable = flags&SESSION_DURABLE != 0
+	copy(s.Token[:], payload[32:48])
+	payload = payload[SESSION_FIXED:]
+
+	if s.Files < 0 || s.Size < 0 || s.More < 0 {
+		return s, fmt.Errorf("session malformed")
+	}
+
+	for len(payload) != 0 {
+		if len(payload) < 2 {
+			return s, fmt.Errorf("session truncated")
+		}
+		n := int(binary.BigEndian.Uint16(payload[0:2]))
+		if 2+n > len(payload) {
+			return s, fmt.Errorf("session truncated")
+		}
+		s.Top = append(s.Top, string(payload[2:2+n]))
+		payload = payload[2+n:]
+	}
+
+	return s, nil
+}
@@ -4,136 +4,235 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"net"
+	"os"
+	"strings"
 	"sync"
 	"time"
+
+	"wire/format"
+	"wire/transfer"
 )
 
-var connections int = 0
+//terminal output is shared by every connection
 var guard sync.Mutex
 
-func receive_display_progress(t transfer) {
-	// fancy display showing progress
-	// only suitable for 1 connection sending 1 file at a time
+//one row per active connection, redrawn under the log of finished files
+type receive_row struct {
+	s transfer.Session
+	t transfer.File
+}
+
+var rows = make([]*receive_row, 0)
+var rows_drawn = 0
+var last_draw int64
+var prompting = false
+
+var DRAW_INTERVAL = int64(50 * time.Millisecond)
+
+func clear_rows() {
+	//the cursor always sits on the line after the last row
+	if rows_drawn != 0 {
+		fmt.Printf("\033[%dA\033[G\033[J", rows_drawn)
+		rows_drawn = 0
+	}
+}
+
+func draw_rows() {
+	clear_rows()
+	if prompting {
+		return
+	}
+
+	width := terminal_width()
+	for _, row := range rows {
+		draw_row(row, width)
+	}
+	rows_drawn = len(rows)
+	last_draw = transfer.Now()
+}
 
-	progress := float64(t.progress) / float64(t.size)
+func truncate(text string, width int) string {
+	//keep the end of paths, its usually the interesting part
+	if width <= 0 {
+		return ""
+	}
+	if len(text) <= width {
+		return text
+	}
+	if width <= 3 {
+		return text[len(text)-width:]
+	}
+	return "..." + text[len(text)-width+3:]
+}
 
-	fmt.Printf("\033[G\033[J%s ", t.name)
+func draw_row(row *receive_row, width int) {
+	//never fill the last column, wrapping would break the cursor movement
+	width--
 
-	if t.progress != t.size {
+	peer := truncate(row.s.Peer, 16)
+	t := row.t
+
+	if t.Name == "" {
+		fmt.Printf("%s\n", truncate(peer+" waiting", width))
+		return
+	}
+
+	progress := 0.0
+	if t.Size != 0 {
+		progress = float64(t.Progress) / float64(t.Size)
+	}
+	elapsed := float64(transfer.Now()-t.Start) / 1000000.0
+	speed := format.Speed(t.Progress-t.Resumed, elapsed)
+
+	//drop columns as the terminal gets narrower, the percentage goes last
+	fixed := len(peer) + 1 + 7
+	switch {
+	case width >= fixed+len(speed)+1+8:
+		name := truncate(t.Name, width-fixed-len(speed)-1)
+		fmt.Printf("%s %s ", peer, name)
 		set_progress_color(progress)
-		fmt.Printf("%5.1f%%", 100.0*progress)
+		fmt.Printf("%6.1f%%", 100.0*progress)
 		reset_color()
-	}
-	if t.progress == t.size {
-		elapsed := float64(get_time()-t.start) / 1000000.0
-		set_timing_color(elapsed)
-		fmt.Printf("%s\n", format_elapsed(elapsed))
+		fmt.Printf(" %s\n", speed)
+	case width >= fixed+8:
+		name := truncate(t.Name, width-fixed)
+		fmt.Printf("%s %s ", peer, name)
+		set_progress_color(progress)
+		fmt.Printf("%6.1f%%", 100.0*progress)
+		reset_color()
+		fmt.Println()
+	default:
+		set_progress_color(progress)
+		fmt.Printf("%s", truncate(fmt.Sprintf("%.0f%% %s", 100.0*progress, peer), width))
 		reset_color()
+		fmt.Println()
 	}
 }
 
-func receive_display_basic(t transfer) {
-	// basic display for multiple concurrent connections
-	// need to guard terminal output to avoid mangling text
+func receive_display_done(row *receive_row, t transfer.File) {
+	//finished files are logged above the rows and scroll away
+	elapsed := float64(transfer.Now()-t.Start) / 1000000.0
+	fmt.Printf("%s %s ", row.s.Peer, t.Name)
+	set_timing_color(elapsed)
+	fmt.Printf("%s", format.Elapsed(elapsed))
+	reset_color()
+	fmt.Printf(" %s\n", format.Speed(t.Size-t.Resumed, elapsed))
+}
+
+//progress for one or more connections on a terminal
+type receive_terminal struct {
+	row    *receive_row
+	failed bool
+}
 
+func (d *receive_terminal) SessionStart(s transfer.Session) {
 	guard.Lock()
 	defer guard.Unlock()
 
-	if t.progress == t.size {
-		fmt.Printf("%s ", t.name)
-		elapsed := float64(get_time()-t.start) / 1000000.0
-		set_timing_color(elapsed)
-		fmt.Printf("%s\n", format_elapsed(elapsed))
-		reset_color()
-	}
+	d.row = &receive_row{s: s}
+	rows = append(rows, d.row)
+	draw_rows()
 }
 
-func receive_display(t transfer) {
-	if connections == 1 {
-		receive_display_progress(t)
-	} else {
-		receive_display_basic(t)
+func (d *receive_terminal) File(t transfer.File) {
+	guard.Lock()
+	defer guard.Unlock()
+
+	d.row.t = t
+
+	if t.Progress == t.Resumed || t.Progress == t.Size || transfer.Now()-last_draw >= DRAW_INTERVAL {
+		draw_rows()
 	}
 }
 
-func add_connection_display() {
+func (d *receive_terminal) FileDone(t transfer.File) {
 	guard.Lock()
 	defer guard.Unlock()
 
-	prev := connections
-	connections++
-	if prev == 1 {
-		title_color()
-		fmt.Printf("\033[G\033[JSWITCHING TO BASIC DISPLAY\n")
-		reset_color()
-	}
+	clear_rows()
+	receive_display_done(d.row, t)
+	d.row.t = transfer.File{}
+	draw_rows()
 }
 
-func remove_connection_display() {
+func (d *receive_terminal) FileError(name string, err error) {
+	//a file can fail after its last byte, dont leave it sitting at 100%
 	guard.Lock()
-	defer guard.Unlock()
+	d.row.t = transfer.File{}
+	guard.Unlock()
 
-	prev := connections
-	connections--
-	if prev == 2 {
-		title_color()
-		fmt.Printf("\033[G\033[JSWITCHING TO PROGESS DISPLAY\n")
-		reset_color()
-	}
+	show_error(err, fmt.Sprintf("FAIL %s %s", d.row.s.Peer, name))
+	d.failed = true
 }
 
-func receive_all(conn net.Conn) error {
-	var err error
-	reader := bufio.NewReader(conn)
-	add_connection_display()
+func (d *receive_terminal) Reconnecting(attempt, retries int, delay time.Duration, err error) {
+	//only senders reconnect, a dropped sender shows up as a new session
+}
 
-	for {
-		if _, err = reader.Peek(1); err != nil {
-			break
-		}
+func (d *receive_terminal) SessionDone(r transfer.Summary) {
+	if r.Err != nil && !d.failed {
+		show_error(r.Err, fmt.Sprintf("FAIL %s", d.row.s.Peer))
+	}
 
-		var t transfer
-		if t, err = from_wire(reader); err != nil {
-			break
-		}
+	guard.Lock()
+	defer guard.Unlock()
 
-		if err = to_disk(reader, t, receive_display); err != nil {
+	for i, row := range rows {
+		if row == d.row {
+			rows = append(rows[:i], rows[i+1:]...)
 			break
 		}
 	}
+	draw_rows()
+}
 
-	if err == io.EOF {
-		err = nil
-	}
+var stdin = bufio.NewReader(os.Stdin)
 
-	if err != nil {
-		if connections == 1 {
-			fmt.Println()
-		}
-		show_error(err, "FAIL")
+//sessions are asked about one at a time
+var prompt_guard sync.Mutex
+
+func prompt(s transfer.Session) bool {
+	prompt_guard.Lock()
+	defer prompt_guard.Unlock()
+
+	//the event stream stays parseable, the question goes to stderr and a harness answers on stdin
+	var out io.Writer = os.Stdout
+	if output == OUTPUT_JSON {
+		out = os.Stderr
+		emit("session_prompt", map[string]interface{}{"peer": s.Peer, "files": s.Files, "bytes": s.Size, "top": s.Top, "more": s.More, "moving": s.Durable})
 	}
 
-	remove_connection_display()
-	return err
-}
+	//dont hold the display while waiting for an answer, transfers would stall
+	//but keep the progress rows from drawing over the question
+	guard.Lock()
+	clear_rows()
+	prompting = true
+	title_color()
+	for _, name := range s.Top {
+		fmt.Fprintf(out, "  %s\n", name)
+	}
+	if s.More != 0 {
+		fmt.Fprintf(out, "  ...and %s more\n", format.Count(s.More))
+	}
+	reset_color()
+	if s.Durable {
+		//this will be the only copy once its acknowledged
+		fmt.Fprintf(out, "  (moving, the sender removes its copies)\n")
+	}
+	fmt.Fprintf(out, "Accept %s? [y/N] ", transfer.Describe(s))
+	guard.Unlock()
 
-func receive(local string) {
-	addr, _ := net.ResolveTCPAddr("tcp6", fmt.Sprintf("[%s]:%d", local, DATA_PORT))
-	ln, err := net.ListenTCP("tcp6", addr)
+	answer, err := stdin.ReadString('\n')
 	if err != nil {
-		show_error(err, "listening failed")
-		terminate()
-	}
-	for {
-		conn, err := ln.AcceptTCP()
-		if err != nil {
-			show_error(err, "accepting failed")
-			continue
-		}
-		conn.SetKeepAlive(true)
-		conn.SetKeepAlivePeriod(time.Second)
-
-		go receive_all(conn)
+		//no terminal to answer from
+		fmt.Fprintln(out)
 	}
+
+	guard.Lock()
+	prompting = false
+	draw_rows()
+	guard.Unlock()
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
 }
@@ -1,159 +1,212 @@
 package main
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
-	"io/fs"
 	"math"
-	"net"
-	"os"
-	"path/filepath"
+	"time"
+
+	"wire/format"
+	"wire/transfer"
 )
 
-type queue struct {
-	pending []*transfer
-	total   int
-}
+//the regular progress display on a terminal
+type send_terminal struct {
+	s transfer.Session
 
-func new_queue() queue {
-	var q queue
-	q.pending = make([]*transfer, 0)
-	return q
-}
+	//aggregate progress over the whole session
+	start        int64
+	done         int64
+	current      int64
+	sample_time  int64
+	sample_bytes int64
+	rate         float64
 
-func (q *queue) enqueue_transfer(t *transfer) {
-	q.total++
-	t.number = q.total
-	t.q = q
-	q.pending = append(q.pending, t)
+	//a file whose ack went with a dropped link is sent again, it only counts the first time
+	counted map[int]bool
+
+	//the file with its name and status lines at the bottom, files sent ahead of their acknowledgement give way
+	shown   transfer.File
+	showing bool
 }
 
-func (q *queue) enqueue_folder(folder string) error {
-	parent := filepath.Dir(folder)
-	err := filepath.WalkDir(folder, func(path string, info os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+//how long the current speed is measured over
+var RATE_WINDOW = int64(500 * time.Millisecond)
 
-		if !info.IsDir() {
-			name, _ := filepath.Rel(parent, path)
+func (d *send_terminal) update(t transfer.File, now int64) {
+	if d.counted[t.Number] {
+		d.current = d.done
+	} else {
+		d.current = d.done + t.Progress
+	}
+	if t.Progress == t.Size && !d.counted[t.Number] {
+		d.done += t.Size
+		d.counted[t.Number] = true
+	}
 
-			t, _ := from_file(path, name)
-			q.enqueue_transfer(&t)
+	if d.sample_time == 0 || now-d.sample_time >= RATE_WINDOW {
+		if d.sample_time != 0 {
+			d.rate = float64(d.current-d.sample_bytes) / (float64(now-d.sample_time) / 1e9)
 		}
-		return nil
-	})
+		d.sample_time = now
+		d.sample_bytes = d.current
+	}
+}
 
-	return err
+func (d *send_terminal) average(now int64) float64 {
+	elapsed := float64(now-d.start) / 1e9
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(d.current) / elapsed
 }
 
-func (q *queue) enqueue_path(path string) {
-	//expand any wildcards
-	paths := expand_path(path)
+func (d *send_terminal) speed(now int64) float64 {
+	//until the first window has passed the average is all there is
+	if d.rate <= 0 {
+		return d.average(now)
+	}
+	return d.rate
+}
 
-	for _, path := range paths {
-		var i fs.FileInfo
-		i, err := os.Stat(path)
-		if err != nil {
-			continue
-		}
-		is_dir := i.IsDir()
-
-		var t transfer
-		if !is_dir {
-			if t, err = from_file(path, i.Name()); err != nil {
-				continue
-			}
-			q.enqueue_transfer(&t)
-		} else {
-			q.enqueue_folder(path)
-		}
+func (d *send_terminal) eta(now int64) string {
+	speed := d.speed(now)
+	if speed <= 0 {
+		return "--:--"
 	}
+	return format.Duration(float64(d.s.Size-d.current) / speed)
 }
 
-func send_display(t transfer) {
-	progress := float64(t.progress) / float64(t.size)
+func (d *send_terminal) SessionStart(s transfer.Session) {
+	d.s = s
+	d.start = transfer.Now()
+	d.counted = make(map[int]bool)
+}
 
-	if t.progress == t.size {
-		fmt.Printf("\033[6D\033[A\033[J")
-	}
+func (d *send_terminal) number(t transfer.File) {
+	total := d.s.Files
+	width := int(math.Floor(math.Log10(float64(total))) + 1)
+	set_progress_color(float64(t.Number) / float64(total))
+	fmt.Printf("[%*d/%*d] ", width, t.Number, width, total)
+	reset_color()
+}
+
+func (d *send_terminal) status(t transfer.File, now int64) {
+	//status line under the name, this file and then the whole session
+	progress := float64(t.Progress) / float64(t.Size)
+	fmt.Print("\033[G\033[K")
+	set_progress_color(progress)
+	fmt.Printf("%5.1f%%", 100.0*progress)
+	reset_color()
+	fmt.Printf("  %s / %s  %s/s  avg %s/s  eta %s", format.Bytes(d.current), format.Bytes(d.s.Size), format.Bytes(int64(d.speed(now))), format.Bytes(int64(d.average(now))), d.eta(now))
+}
 
-	if t.progress == 0 || t.progress == t.size {
-		total_progress := float64(t.number) / float64(t.q.total)
-		width := int(math.Floor(math.Log10(float64(t.q.total))) + 1)
+func (d *send_terminal) show(t transfer.File, now int64) {
+	d.number(t)
+	fmt.Printf("%s\n", t.Name)
+	d.status(t, now)
+	d.shown, d.showing = t, true
+}
 
-		set_progress_color(total_progress)
-		fmt.Printf("[%*d/%*d] ", width, t.number, width, t.q.total)
-		reset_color()
-		fmt.Printf("%s", t.name)
-	}
-	if t.progress == 0 {
-		fmt.Println()
-	}
-	if t.progress != t.size {
-		set_progress_color(progress)
-		fmt.Printf("\033[6D%5.1f%%", 100.0*progress)
-		reset_color()
-	}
-	if t.progress == t.size {
-		elapsed := float64(get_time()-t.start) / 1000000.0
-		set_timing_color(elapsed)
-		fmt.Printf(" %s", format_elapsed(elapsed))
-		fmt.Print("\033[0m\n")
+func (d *send_terminal) hide() {
+	//the cursor sits on the status line, the name is above it
+	if d.showing {
+		fmt.Print("\033[G\033[A\033[J")
+		d.showing = false
 	}
 }
 
-func send_display_basic(t transfer) {
-	if t.progress == 0 {
-		total_progress := float64(t.number) / float64(t.q.total)
-		width := int(math.Floor(math.Log10(float64(t.q.total))) + 1)
+func (d *send_terminal) File(t transfer.File) {
+	now := transfer.Now()
+	d.update(t, now)
 
-		set_progress_color(total_progress)
-		fmt.Printf("[%*d/%*d] ", width, t.number, width, t.q.total)
-		reset_color()
-		fmt.Printf("%s", t.name)
-		fmt.Println()
+	//nothing to send, it shows up once its acknowledged
+	if t.Size == t.Resumed {
+		return
 	}
+
+	if t.Progress == t.Resumed || !d.showing || d.shown.Number != t.Number {
+		d.hide()
+		d.show(t, now)
+		return
+	}
+	d.shown = t
+	d.status(t, now)
 }
 
-func send(paths []string, local, remote string) error {
-	var err error
+func (d *send_terminal) FileDone(t transfer.File) {
+	now := transfer.Now()
+	current, showing := d.shown, d.showing
 
-	raddr, _ := net.ResolveTCPAddr("tcp6", fmt.Sprintf("[%s]:%d", remote, DATA_PORT))
-	laddr, _ := net.ResolveTCPAddr("tcp6", fmt.Sprintf("[%s]:%d", local, DATA_PORT))
-	laddr.Port = 0
+	//finished lines go above whatever is still being sent
+	d.hide()
+	d.number(t)
+	fmt.Printf("%s", t.Name)
 
-	conn, err := net.DialTCP("tcp6", laddr, raddr)
-	if err != nil {
-		show_error(err, "dial failed")
-		terminate()
+	elapsed := float64(now-t.Start) / 1000000.0
+	set_timing_color(elapsed)
+	fmt.Printf(" %s", format.Elapsed(elapsed))
+	reset_color()
+	fmt.Printf(" %s\n", format.Speed(t.Size-t.Resumed, elapsed))
+
+	if showing && current.Number != t.Number {
+		d.show(current, now)
 	}
-	defer conn.Close()
+}
 
-	writer := bufio.NewWriter(conn)
+func (d *send_terminal) FileError(name string, err error) {
+	current, showing := d.shown, d.showing
+	d.hide()
+	show_error(err, fmt.Sprintf("FAIL %s", name))
+	if showing && current.Name != name {
+		d.show(current, transfer.Now())
+	}
+}
 
-	q := new_queue()
+func (d *send_terminal) Reconnecting(attempt, retries int, delay time.Duration, err error) {
+	//the status line of the file that was cut off goes, its name stays until its picked up again
+	fmt.Print("\033[G\033[K")
+	d.showing = false
+	show_reconnect("", attempt, retries, delay, err)
+}
 
-	for _, path := range paths {
-		q.enqueue_path(path)
-	}
+func (d *send_terminal) SessionDone(r transfer.Summary) {
+	//an interrupted file leaves its status line behind
+	fmt.Print("\033[G\033[K")
+	show_summary("sent", r)
+}
 
-	for _, p := range q.pending {
-		header := p.build_header()
-		if err = write_from_buffer(writer, header); err != nil {
-			break
+func show_plan(plan transfer.Plan, as_json bool) {
+	if as_json {
+		type json_file struct {
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		}
+		type json_plan struct {
+			Files    []json_file         `json:"files"`
+			Count    int                 `json:"count"`
+			Bytes    int64               `json:"bytes"`
+			Skipped  []map[string]string `json:"skipped"`
+			Filtered int64               `json:"filtered"`
 		}
 
-		if err = to_wire(writer, *p, send_display); err != nil {
-			break
+		out := json_plan{Files: make([]json_file, 0, len(plan.Files)), Count: len(plan.Files), Bytes: plan.Size, Skipped: failure_fields(plan.Skipped), Filtered: plan.Filtered}
+		for _, f := range plan.Files {
+			out.Files = append(out.Files, json_file{f.Name, f.Size})
 		}
-		writer.Flush()
-	}
 
-	if err != nil {
-		fmt.Print("\033[6D\033[J")
-		show_error(err, "FAIL")
+		data, _ := json.MarshalIndent(out, "", "  ")
+		fmt.Println(string(data))
+		return
 	}
 
-	return nil
+	//exactly the names the receiver would be sent
+	for _, f := range plan.Files {
+		fmt.Printf("%10s  %s\n", format.Bytes(f.Size), f.Name)
+	}
+	show_info(fmt.Sprintf("%s files (%s) would be sent", format.Count(int64(len(plan.Files))), format.Bytes(plan.Size)))
+	if plan.Filtered != 0 {
+		show_info(fmt.Sprintf("%s entries left out by filters", format.Count(plan.Filtered)))
+	}
+	show_failures("skipped", plan.Skipped)
 }
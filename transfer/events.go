@@ -0,0 +1,98 @@
+package transfer
+
+import (
+	"io/fs"
+	"time"
+)
+
+//everything a session reports while it runs
+type Events interface {
+	SessionStart(s Session)
+	File(f File)
+	FileError(name string, err error)
+
+	//the file is on the receivers disk, a sender only hears once the receiver has acknowledged it
+	FileDone(f File)
+	SessionDone(r Summary)
+
+	//the link dropped and another is tried after delay, attempt counts up to retries
+	Reconnecting(attempt, retries int, delay time.Duration, err error)
+}
+
+//a session as seen from this side, peer is whoever is on the other end
+type Session struct {
+	ID      int64
+	Peer    string
+	Address string
+
+	Files int64
+	Size  int64
+	Top   []string
+	More  int64
+
+	//the sender wants every file on the disk before its acknowledged
+	Durable bool
+}
+
+//progress of a single file, reported when it starts and as it moves
+type File struct {
+	Name     string
+	Number   int
+	Size     int64
+	Progress int64
+	Start    int64
+
+	//progress made over an earlier link, a resumed file starts here instead of 0
+	Resumed int64
+}
+
+type Failure struct {
+	Name string
+	Err  error
+}
+
+type Summary struct {
+	Files   int64
+	Total   int64
+	Bytes   int64
+	Elapsed float64
+
+	Skipped []Failure
+	Failed  []Failure
+	Err     error
+
+	//left out on purpose by a filter, not an error
+	Filtered int64
+}
+
+func (r Summary) Rate() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / (r.Elapsed / 1000.0)
+}
+
+//for callers that dont want to hear about it
+type no_events struct{}
+
+func (no_events) SessionStart(s Session)                                            {}
+func (no_events) File(f File)                                                       {}
+func (no_events) FileError(name string, err error)                                  {}
+func (no_events) FileDone(f File)                                                   {}
+func (no_events) SessionDone(r Summary)                                             {}
+func (no_events) Reconnecting(attempt, retries int, delay time.Duration, err error) {}
+
+func events_or_nothing(e Events) Events {
+	if e == nil {
+		return no_events{}
+	}
+	return e
+}
+
+func ErrorMessage(err error) string {
+	//dont leak the receivers absolute paths back to the peer
+	if e, ok := err.(*fs.PathError); ok {
+		return e.Err.Error()
+	}
+	return err.Error()
+}
@@ -0,0 +1,209 @@
+package transfer
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//ignore files read from each folder when Filter.IgnoreFiles is set
+var IGNORE_FILES = []string{".gitignore", ".wireignore"}
+
+//which files inside folders get sent, patterns are gitignore style
+//names without a slash match at any depth, a leading slash anchors to the folder being sent
+//a trailing slash only matches folders and ** matches any number of folders
+type Filter struct {
+	Exclude []string
+
+	//when set only matching files are sent, a match also overrides Exclude
+	Include []string
+
+	//honour ignore files found on the way down and skip .git
+	IgnoreFiles bool
+}
+
+type rule struct {
+	//the folder the pattern came from, relative to the folder being sent
+	base    string
+	pattern string
+
+	negate   bool
+	dir_only bool
+	anchored bool
+}
+
+func parse_rule(base, line string) (rule, bool) {
+	r := rule{base: base}
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false
+	}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dir_only = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return r, false
+	}
+
+	r.pattern = line
+	return r, true
+}
+
+func (r rule) match(name string, is_dir bool) bool {
+	if r.dir_only && !is_dir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(name, r.base+"/") {
+			return false
+		}
+		name = name[len(r.base)+1:]
+	}
+
+	if !r.anchored {
+		matched, _ := path.Match(r.pattern, path.Base(name))
+		return matched
+	}
+	return match_parts(strings.Split(r.pattern, "/"), strings.Split(name, "/"))
+}
+
+func match_parts(pattern, name []string) bool {
+	for len(pattern) != 0 {
+		if pattern[0] == "**" {
+			//any number of folders, including none
+			for i := 0; i <= len(name); i++ {
+				if match_parts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+func parse_rules(base string, lines []string) []rule {
+	out := make([]rule, 0)
+	for _, line := range lines {
+		if r, ok := parse_rule(base, line); ok {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func matches(rules []rule, name string, is_dir bool) bool {
+	//the last rule that matches decides, like git
+	matched := false
+	for _, r := range rules {
+		if r.match(name, is_dir) {
+			matched = !r.negate
+		}
+	}
+	return matched
+}
+
+func ReadPatterns(path string) ([]string, error) {
+	//one pattern per line, blank lines and # comments are skipped later
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	out := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		out = append(out, scanner.Text())
+	}
+	return out, scanner.Err()
+}
+
+//a filter as its applied while walking, with the ignore files read so far
+type walk_filter struct {
+	filter  *Filter
+	exclude []rule
+	include []rule
+	ignored []rule
+}
+
+func new_walk_filter(f *Filter) *walk_filter {
+	w := &walk_filter{filter: f}
+	if f != nil {
+		w.exclude = parse_rules("", f.Exclude)
+		w.include = parse_rules("", f.Include)
+	}
+	return w
+}
+
+func (w *walk_filter) read_ignores(folder, base string) {
+	//patterns in a folders ignore files only apply below it
+	if w.filter == nil || !w.filter.IgnoreFiles {
+		return
+	}
+	for _, name := range IGNORE_FILES {
+		lines, err := ReadPatterns(filepath.Join(folder, name))
+		if err != nil {
+			continue
+		}
+		w.ignored = append(w.ignored, parse_rules(base, lines)...)
+	}
+}
+
+func (w *walk_filter) included(name string, is_dir bool) bool {
+	//an included folder includes everything in it
+	if matches(w.include, name, is_dir) {
+		return true
+	}
+	for i := range name {
+		if name[i] == '/' && matches(w.include, name[:i], true) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *walk_filter) skip(name string, is_dir bool) bool {
+	if w.filter == nil {
+		return false
+	}
+
+	//folders are walked into so included files below them can be found
+	if w.included(name, is_dir) {
+		return false
+	}
+	if len(w.include) != 0 && !is_dir {
+		return true
+	}
+
+	if matches(w.exclude, name, is_dir) {
+		return true
+	}
+	if w.filter.IgnoreFiles {
+		if is_dir && path.Base(name) == ".git" {
+			return true
+		}
+		return matches(w.ignored, name, is_dir)
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRuleMatch(t *testing.T) {
+	cases := []struct {
+		base, pattern, name string
+		is_dir              bool
+		want                bool
+	}{
+		{"", "node_modules", "node_modules", true, true},
+		{"", "node_modules", "web/node_modules", true, true},
+		{"", "*.o", "src/a.o", false, true},
+		{"", "*.o", "src/a.c", false, false},
+		{"", "build/", "build", false, false},
+		{"", "build/", "src/build", true, true},
+		{"", "/dist", "dist", true, true},
+		{"", "/dist", "web/dist", true, false},
+		{"", "docs/*.pdf", "docs/a.pdf", false, true},
+		{"", "docs/*.pdf", "docs/sub/a.pdf", false, false},
+		{"", "docs/**/*.pdf", "docs/sub/deeper/a.pdf", false, true},
+		{"", "docs/**/*.pdf", "docs/a.pdf", false, true},
+		{"", "**/tmp", "a/b/tmp", true, true},
+		{"web", "*.log", "web/x.log", false, true},
+		{"web", "*.log", "x.log", false, false},
+		{"web", "/out", "web/out", true, true},
+		{"web", "/out", "web/sub/out", true, false},
+	}
+
+	for _, c := range cases {
+		r, ok := parse_rule(c.base, c.pattern)
+		if !ok {
+			t.Fatalf("%q: not parsed", c.pattern)
+		}
+		if got := r.match(c.name, c.is_dir); got != c.want {
+			t.Errorf("%q in %q against %q: got %v", c.pattern, c.base, c.name, got)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment", "/", "!"} {
+		if _, ok := parse_rule("", line); ok {
+			t.Errorf("%q parsed", line)
+		}
+	}
+}
+
+func TestRulesNegate(t *testing.T) {
+	rules := parse_rules("", []string{"*.log", "!keep.log"})
+	if !matches(rules, "a.log", false) || matches(rules, "keep.log", false) {
+		t.Fatal("negation ignored")
+	}
+}
+
+func queued(t *testing.T, filter *Filter, folder string) ([]string, int64) {
+	q := new_queue(filter)
+	q.enqueue_path(folder)
+	if len(q.skipped) != 0 {
+		t.Fatalf("skipped %v", q.skipped)
+	}
+
+	names := make([]string, 0)
+	for _, p := range q.pending {
+		names = append(names, p.name)
+	}
+	sort.Strings(names)
+	return names, q.filtered
+}
+
+func TestQueueFilter(t *testing.T) {
+	root := t.TempDir()
+	write_tree(t, root, map[string][]byte{
+		"repo/main.go":              nil,
+		"repo/main.o":               nil,
+		"repo/.gitignore":           []byte("# build output\n*.o\n/out/\n"),
+		"repo/.git/HEAD":            nil,
+		"repo/out/bin":              nil,
+		"repo/web/.wireignore":      []byte("*.map\n!keep.map\n"),
+		"repo/web/app.js":           nil,
+		"repo/web/app.map":          nil,
+		"repo/web/keep.map":         nil,
+		"repo/web/out/page":         nil,
+		"repo/node_modules/x/y.js":  nil,
+		"repo/docs/guide/intro.txt": nil,
+	})
+	folder := filepath.Join(root, "repo")
+
+	names, filtered := queued(t, nil, folder)
+	if len(names) != 12 || filtered != 0 {
+		t.Fatalf("without a filter got %v and %d filtered", names, filtered)
+	}
+
+	filter := &Filter{Exclude: []string{"node_modules"}, IgnoreFiles: true}
+	names, filtered = queued(t, filter, folder)
+	want := []string{"repo/.gitignore", "repo/docs/guide/intro.txt", "repo/main.go", "repo/web/.wireignore", "repo/web/app.js", "repo/web/keep.map", "repo/web/out/page"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+	//.git, main.o, out, app.map and node_modules
+	if filtered != 5 {
+		t.Fatalf("%d filtered, want 5", filtered)
+	}
+
+	filter = &Filter{Include: []string{"*.js", "docs/"}}
+	names, _ = queued(t, filter, folder)
+	want = []string{"repo/docs/guide/intro.txt", "repo/node_modules/x/y.js", "repo/web/app.js"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+}
+
+func TestReadPatterns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "excludes")
+	if err := os.WriteFile(path, []byte("a\r\n# b\n\nc/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := ReadPatterns(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := parse_rules("", lines); len(rules) != 2 || rules[0].pattern != "a" || !rules[1].dir_only {
+		t.Fatalf("got %+v", rules)
+	}
+}
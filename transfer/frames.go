@@ -0,0 +1,186 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"wire/protocol"
+)
+
+//how long a peer gets to hear about an abort before the link is dropped
+var ABORT_TIMEOUT = 2 * time.Second
+
+var ERR_INTERRUPTED = fmt.Errorf("interrupted")
+
+//reasons sent to the peer are cut to this, theyre for people not programs
+var MAX_REASON = 1024
+
+//the other side gave up on one file and said why
+type CancelError struct {
+	Reason string
+}
+
+func (e *CancelError) Error() string {
+	return "cancelled by peer: " + e.Reason
+}
+
+//a problem with a file on this side, the link itself is still fine
+type local_error struct {
+	err error
+}
+
+func (e *local_error) Error() string {
+	return e.err.Error()
+}
+
+func (e *local_error) Unwrap() error {
+	return e.err
+}
+
+//wraps errors from the disk so theyre not mistaken for a broken link
+type local_file struct {
+	file io.ReadWriter
+}
+
+func (f local_file) Read(p []byte) (int, error) {
+	//only ever asked for what the file had when it was queued
+	n, err := f.file.Read(p)
+	if err == io.EOF {
+		err = fmt.Errorf("file shrank while sending")
+	}
+	if err != nil {
+		err = &local_error{err}
+	}
+	return n, err
+}
+
+func (f local_file) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	if err != nil {
+		err = &local_error{err}
+	}
+	return n, err
+}
+
+func reason(err error) []byte {
+	message := ErrorMessage(err)
+	if len(message) > MAX_REASON {
+		message = message[:MAX_REASON]
+	}
+	return []byte(message)
+}
+
+//the other side gave up and said why
+type AbortError struct {
+	Reason string
+}
+
+func (e *AbortError) Error() string {
+	return "aborted by peer: " + e.Reason
+}
+
+//file data travels in frames so control messages can be sent between them
+type frame_writer struct {
+	writer io.Writer
+}
+
+func (w frame_writer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	h := protocol.Header{Kind: protocol.KIND_DATA, Size: int64(len(p))}
+	if err := protocol.WriteBuffer(w.writer, h.Build()); err != nil {
+		return 0, err
+	}
+	if err := protocol.WriteBuffer(w.writer, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type frame_reader struct {
+	ctx    context.Context
+	reader io.Reader
+
+	//whats left of the current frame and how much file data has been read
+	left int64
+	read int64
+}
+
+func (r *frame_reader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, ERR_INTERRUPTED
+	}
+
+	for r.left == 0 {
+		h, err := protocol.ReadHeader(r.reader)
+		if err != nil {
+			return 0, err
+		}
+
+		switch h.Kind {
+		case protocol.KIND_DATA:
+			r.left = h.Size
+		case protocol.KIND_ABORT:
+			return 0, &AbortError{h.Name}
+		case protocol.KIND_CANCEL:
+			payload, err := protocol.ReadPayload(r.reader, h)
+			if err != nil {
+				return 0, err
+			}
+			return 0, &CancelError{string(payload)}
+		default:
+			return 0, fmt.Errorf("unexpected message")
+		}
+	}
+
+	n := min(len(p), r.left)
+	n, err := r.reader.Read(p[:n])
+	r.left -= int64(n)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *frame_reader) discard(size int64) error {
+	//skip the rest of a file, stopping early if the sender cancels it
+	_, err := io.CopyN(io.Discard, r, size-r.read)
+	return err
+}
+
+//messages going back the other way, written from more than one goroutine
+type control struct {
+	guard  sync.Mutex
+	writer *bufio.Writer
+}
+
+func (c *control) send(kind byte, name string, payload []byte) error {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+
+	if err := protocol.WriteMessage(c.writer, kind, name, payload); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func half_close(conn net.Conn) {
+	//let the peer read everything we sent before it sees the end
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+func deadline_on_cancel(ctx context.Context, conn net.Conn) {
+	//blocked reads and writes get long enough to say goodbye, then fail
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now().Add(ABORT_TIMEOUT))
+	}()
+}
@@ -0,0 +1,54 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"wire/protocol"
+)
+
+//a session as a sender would put it on the wire
+func session_stream(files map[string][]byte) []byte {
+	var stream bytes.Buffer
+
+	announced := protocol.Session{Name: "fuzz"}
+	for name, data := range files {
+		announced.Files++
+		announced.Size += int64(len(data))
+		announced.Top = append(announced.Top, name)
+	}
+	protocol.WriteMessage(&stream, protocol.KIND_SESSION, announced.Name, announced.Build())
+
+	for name, data := range files {
+		file := protocol.Header{Kind: protocol.KIND_FILE, Size: int64(len(data)), Name: name}
+		stream.Write(file.Build())
+		frame_writer{&stream}.Write(data)
+	}
+	return stream.Bytes()
+}
+
+func FuzzReceive(f *testing.F) {
+	f.Add(session_stream(map[string][]byte{"a": []byte("hello"), "d/b": {}}))
+	f.Add(session_stream(map[string][]byte{"../escape": []byte("x")}))
+	f.Add(protocol.Header{Kind: protocol.KIND_LIST, Name: "."}.Build())
+	f.Add(protocol.Header{Kind: protocol.KIND_SESSION, Size: 1 << 62, Name: "big"}.Build())
+	f.Add([]byte{0, 3, protocol.KIND_FILE})
+	f.Add([]byte{0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		//limits keep a lucky input from filling the disk
+		receiver := Receiver{Root: t.TempDir(), Share: true, AutoAccept: true, MaxBytes: 1 << 20, MaxFiles: 100}
+
+		client, server := net.Pipe()
+		go io.Copy(io.Discard, client)
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+
+		receiver.receive_all(context.Background(), server, func() {})
+	})
+}
@@ -0,0 +1,135 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+//reads are cut to this so a low rate still flows instead of arriving in bursts
+var LIMIT_QUANTUM = 32 * 1024
+
+//a daily window, From after To wraps past midnight
+type Schedule struct {
+	From time.Duration
+	To   time.Duration
+}
+
+func ParseSchedule(text string) (*Schedule, error) {
+	//HH:MM-HH:MM in local time
+	var from_h, from_m, to_h, to_m int
+	if _, err := fmt.Sscanf(text, "%d:%d-%d:%d", &from_h, &from_m, &to_h, &to_m); err != nil {
+		return nil, fmt.Errorf("invalid schedule %q, use HH:MM-HH:MM", text)
+	}
+	for _, v := range []int{from_h, to_h} {
+		if v < 0 || v > 24 {
+			return nil, fmt.Errorf("invalid schedule %q, use HH:MM-HH:MM", text)
+		}
+	}
+	for _, v := range []int{from_m, to_m} {
+		if v < 0 || v > 59 {
+			return nil, fmt.Errorf("invalid schedule %q, use HH:MM-HH:MM", text)
+		}
+	}
+
+	s := &Schedule{}
+	s.From = time.Duration(from_h)*time.Hour + time.Duration(from_m)*time.Minute
+	s.To = time.Duration(to_h)*time.Hour + time.Duration(to_m)*time.Minute
+	if s.From > 24*time.Hour || s.To > 24*time.Hour {
+		return nil, fmt.Errorf("invalid schedule %q, use HH:MM-HH:MM", text)
+	}
+	return s, nil
+}
+
+func (s *Schedule) active(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	t := now.Sub(midnight)
+	if s.From <= s.To {
+		return t >= s.From && t < s.To
+	}
+	return t >= s.From || t < s.To
+}
+
+//a token bucket shared by every transfer given it, together they stay under the rate
+type Limiter struct {
+	guard sync.Mutex
+
+	//bytes per second, 0 is unlimited
+	rate int64
+
+	//the limit only applies inside this window when set
+	schedule *Schedule
+
+	//when everything taken so far has been paid for
+	next time.Time
+}
+
+func NewLimiter(rate int64, schedule *Schedule) *Limiter {
+	return &Limiter{rate: rate, schedule: schedule}
+}
+
+func (l *Limiter) SetRate(rate int64) {
+	l.guard.Lock()
+	defer l.guard.Unlock()
+	l.rate = rate
+	//dont make the new rate pay for the old one
+	l.next = time.Time{}
+}
+
+func (l *Limiter) Rate() int64 {
+	l.guard.Lock()
+	defer l.guard.Unlock()
+	return l.rate
+}
+
+func (l *Limiter) take(n int, now time.Time) time.Duration {
+	l.guard.Lock()
+	defer l.guard.Unlock()
+
+	if l.rate <= 0 || (l.schedule != nil && !l.schedule.active(now)) {
+		l.next = time.Time{}
+		return 0
+	}
+
+	//idle time isnt saved up, a pause doesnt buy a burst afterwards
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	return delay
+}
+
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	delay := l.take(n, time.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ERR_INTERRUPTED
+	}
+}
+
+type limited_reader struct {
+	ctx    context.Context
+	reader io.Reader
+	limit  *Limiter
+}
+
+func (r limited_reader) Read(p []byte) (int, error) {
+	if len(p) > LIMIT_QUANTUM {
+		p = p[:LIMIT_QUANTUM]
+	}
+	if err := r.limit.wait(r.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
@@ -0,0 +1,102 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	s, err := ParseSchedule("08:30-18:00")
+	if err != nil || s.From != 8*time.Hour+30*time.Minute || s.To != 18*time.Hour {
+		t.Fatalf("got %+v, %v", s, err)
+	}
+
+	for _, text := range []string{"", "8-18", "25:00-01:00", "08:60-09:00", "24:30-01:00"} {
+		if _, err := ParseSchedule(text); err == nil {
+			t.Errorf("%q parsed", text)
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	at := func(h, m int) time.Time {
+		return time.Date(2024, 1, 1, h, m, 0, 0, time.Local)
+	}
+
+	day, _ := ParseSchedule("08:00-18:00")
+	night, _ := ParseSchedule("22:00-06:00")
+	cases := []struct {
+		s    *Schedule
+		now  time.Time
+		want bool
+	}{
+		{day, at(7, 59), false},
+		{day, at(8, 0), true},
+		{day, at(17, 59), true},
+		{day, at(18, 0), false},
+		{night, at(23, 0), true},
+		{night, at(3, 0), true},
+		{night, at(12, 0), false},
+	}
+	for _, c := range cases {
+		if got := c.s.active(c.now); got != c.want {
+			t.Errorf("%v at %s: got %v", c.s, c.now.Format("15:04"), got)
+		}
+	}
+}
+
+func TestLimiterTake(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(1000, nil)
+
+	//the first read goes straight away, later ones wait their turn
+	if d := l.take(500, now); d != 0 {
+		t.Fatalf("first take waited %v", d)
+	}
+	if d := l.take(500, now); d != 500*time.Millisecond {
+		t.Fatalf("second take waited %v", d)
+	}
+	if d := l.take(1, now.Add(2*time.Second)); d != 0 {
+		t.Fatalf("idle time not forgiven, waited %v", d)
+	}
+
+	l.SetRate(0)
+	if d := l.take(1<<30, now); d != 0 {
+		t.Fatalf("unlimited waited %v", d)
+	}
+
+	//outside the window its full speed
+	closed := &Schedule{From: time.Hour, To: time.Hour}
+	l = NewLimiter(1, closed)
+	l.take(1000, now)
+	if d := l.take(1000, now); d != 0 {
+		t.Fatalf("outside the schedule waited %v", d)
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 64*1024)
+
+	//64K at 256K/s, the first quantum is free
+	l := NewLimiter(256*1024, nil)
+	start := time.Now()
+	reader := limited_reader{context.Background(), bytes.NewReader(data), l}
+	got, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l = NewLimiter(1, nil)
+	l.take(1000, time.Now())
+	if _, err := (limited_reader{ctx, bytes.NewReader(data), l}).Read(make([]byte, 10)); err != ERR_INTERRUPTED {
+		t.Fatalf("got %v", err)
+	}
+}
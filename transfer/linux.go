@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package transfer
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+func Now() int64 {
+	return time.Now().UnixNano()
+}
+
+func free_space(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+func is_disk_full(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+func sync_dir(path string) error {
+	//the new entry isnt durable until its directory is
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
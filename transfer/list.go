@@ -0,0 +1,122 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"wire/protocol"
+)
+
+func list_directory(root, name string) ([]protocol.Entry, error) {
+	//same rules as receiving, the name can never leave the root
+	clean, err := protocol.SanitizeName(name)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(root, clean)
+
+	//a symlink inside the root can point anywhere, only whats really under it is listed
+	if err = within(root, path); err != nil {
+		return nil, err
+	}
+
+	i, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	//listing a single file just describes that file
+	if !i.IsDir() {
+		return []protocol.Entry{{Name: i.Name(), Kind: protocol.EntryKind(i.Mode()), Size: i.Size(), Mtime: i.ModTime().UnixNano()}}, nil
+	}
+
+	items, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]protocol.Entry, 0, len(items))
+	for _, item := range items {
+		info, err := item.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, protocol.Entry{Name: item.Name(), Kind: protocol.EntryKind(info.Mode()), Size: info.Size(), Mtime: info.ModTime().UnixNano()})
+	}
+
+	return entries, nil
+}
+
+func within(root, path string) error {
+	real_root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(real_root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("outside the shared folder")
+	}
+	return nil
+}
+
+func (rcv *Receiver) serve_listing(conn net.Conn, t transfer) error {
+	writer := bufio.NewWriter(conn)
+	defer writer.Flush()
+
+	if !rcv.Share {
+		return protocol.WriteMessage(writer, protocol.KIND_ERROR, "sharing is disabled on this peer", nil)
+	}
+
+	entries, err := list_directory(rcv.root(), t.name)
+	if err != nil {
+		return protocol.WriteMessage(writer, protocol.KIND_ERROR, ErrorMessage(err), nil)
+	}
+
+	return protocol.WriteMessage(writer, protocol.KIND_LISTING, t.name, protocol.BuildListing(entries))
+}
+
+//ask a peer receiving with sharing on whats inside path, over tcp if transport is nil
+func List(ctx context.Context, transport Transport, local, remote, path string) ([]protocol.Entry, error) {
+	conn, err := transport_or_tcp(transport).Dial(ctx, local, remote)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer close_on_cancel(ctx, conn)()
+
+	writer := bufio.NewWriter(conn)
+	if err = protocol.WriteMessage(writer, protocol.KIND_LIST, filepath.ToSlash(path), nil); err != nil {
+		return nil, err
+	}
+	if err = writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	t, err := from_wire(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	switch t.kind {
+	case protocol.KIND_ERROR:
+		return nil, fmt.Errorf("%s", t.name)
+	case protocol.KIND_LISTING:
+		listing, err := protocol.ReadPayload(reader, t.header())
+		if err != nil {
+			return nil, err
+		}
+		return protocol.ParseListing(listing)
+	default:
+		return nil, fmt.Errorf("unexpected response")
+	}
+}
@@ -0,0 +1,167 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//pick a free port on ::1 for DATA_PORT, or skip where theres no ipv6 loopback
+func use_loopback(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no ipv6 loopback: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	previous := DATA_PORT
+	DATA_PORT = port
+	t.Cleanup(func() { DATA_PORT = previous })
+}
+
+//every file under a, relative to a
+func read_tree(t *testing.T, a string) map[string][]byte {
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(a, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, _ := filepath.Rel(a, path)
+		files[filepath.ToSlash(name)], err = os.ReadFile(path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func compare_trees(t *testing.T, want, got string) {
+	a := read_tree(t, want)
+	b := read_tree(t, got)
+
+	for name, data := range a {
+		other, ok := b[name]
+		if !ok {
+			t.Errorf("%s missing", name)
+			continue
+		}
+		if !bytes.Equal(data, other) {
+			t.Errorf("%s differs", name)
+		}
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			t.Errorf("%s unexpected", name)
+		}
+	}
+}
+
+func random_bytes(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestLoopback(t *testing.T) {
+	use_loopback(t)
+	with_chunk_size(t, 4096)
+
+	source := t.TempDir()
+	destination := t.TempDir()
+
+	write_tree(t, filepath.Join(source, "tree"), map[string][]byte{
+		"empty":           {},
+		"one":             {1},
+		"chunk":           random_bytes(4096),
+		"chunks":          random_bytes(3 * 4096),
+		"odd":             random_bytes(3*4096 + 17),
+		"deep/er/still/x": random_bytes(100000),
+		"spaces in name":  []byte("spaces"),
+	})
+	write_tree(t, source, map[string][]byte{"single": random_bytes(5000)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	receiver := Receiver{Local: "::1", Root: destination, AutoAccept: true, Once: true}
+	served := make(chan error, 1)
+	go func() {
+		served <- receiver.Serve(ctx)
+	}()
+
+	sender := Sender{Local: "::1"}
+	var err error
+	for attempt := 0; attempt < 50; attempt++ {
+		//the receiver may not be listening yet
+		if err = sender.Send(ctx, "::1", []string{filepath.Join(source, "tree"), filepath.Join(source, "single")}); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err = <-served; err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+
+	compare_trees(t, source, destination)
+}
+
+//signals each session the receiver finishes
+type done_events struct {
+	no_events
+	done chan Summary
+}
+
+func (e done_events) SessionDone(r Summary) {
+	e.done <- r
+}
+
+func TestLoopbackSessions(t *testing.T) {
+	use_loopback(t)
+
+	source := t.TempDir()
+	destination := t.TempDir()
+	write_tree(t, source, map[string][]byte{"a/1": random_bytes(1000), "b/2": random_bytes(2000)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	done := make(chan Summary, 2)
+	receiver := Receiver{Local: "::1", Root: destination, AutoAccept: true, MaxTotalFiles: 2}
+	receiver.Events = func() Events { return done_events{done: done} }
+	go receiver.Serve(ctx)
+
+	sender := Sender{Local: "::1"}
+	for _, folder := range []string{"a", "b"} {
+		var err error
+		for attempt := 0; attempt < 50; attempt++ {
+			if err = sender.Send(ctx, "::1", []string{filepath.Join(source, folder)}); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("send %s: %v", folder, err)
+		}
+		if r := <-done; r.Err != nil {
+			t.Fatalf("receive %s: %v", folder, r.Err)
+		}
+	}
+
+	compare_trees(t, source, destination)
+
+	//the run limit has been used up
+	if err := sender.Send(ctx, "::1", []string{filepath.Join(source, "a")}); err == nil {
+		t.Fatal("session past the limit accepted")
+	}
+}
@@ -0,0 +1,873 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"wire/format"
+	"wire/protocol"
+)
+
+var ERR_TIMEOUT = fmt.Errorf("nothing received")
+
+//a sender reconnecting within this long isnt asked about again
+var RESUME_WINDOW = time.Hour
+
+//how long once waits on a session cut off by the link, a sender on its default retries is back well before
+var RESUME_WAIT = time.Minute
+
+type accepted_session struct {
+	peer string
+	at   time.Time
+
+	//files that arrived over any of its links
+	arrived map[string]bool
+
+	//parts left by a dropped link for the sender to pick up, by path
+	partials map[string]bool
+	//removes them once the sender has had its chance to come back
+	expiry *time.Timer
+}
+
+type Receiver struct {
+	Local string
+
+	//everything is written under root and listings never leave it
+	Root  string
+	Share bool
+
+	AutoAccept bool
+	Trusted    []string
+
+	//asked about every session that isnt accepted automatically
+	Prompt func(s Session) bool
+
+	//limits per session and for the whole run, 0 is unlimited
+	MaxBytes      int64
+	MaxFiles      int64
+	MaxTotalBytes int64
+	MaxTotalFiles int64
+
+	//flush every file to the disk before acknowledging it
+	Fsync bool
+
+	//every session together stays under this
+	Limit *Limiter
+
+	Once    bool
+	Timeout time.Duration
+	//with once, how long a dropped sender has to reconnect, RESUME_WAIT when not set
+	ResumeWait time.Duration
+
+	//tcp when not set
+	Transport Transport
+
+	//a fresh set of events for each accepted session
+	Events func() Events
+
+	//anything worth telling the user that doesnt belong to a session
+	Error   func(err error, msg string)
+	Info    func(msg string)
+	Verbose func(msg string)
+
+	guard    sync.Mutex
+	sessions int64
+
+	//totals reserved by accepted sessions over the whole run
+	reserved_files int64
+	reserved_bytes int64
+
+	//bytes announced by running sessions that havent been written yet
+	pending_bytes int64
+
+	//by token, so a sender that lost the link can pick up again
+	accepted map[[16]byte]accepted_session
+
+	//files being written, a link picking one up waits for the old link to let go of it
+	writing map[string]chan bool
+}
+
+type session struct {
+	Session
+
+	//what has actually arrived so far
+	received_files int64
+	received_bytes int64
+	skipped_files  int64
+	failed_files   int64
+}
+
+//how a session is shown when asking about it and when logging it
+func Describe(s Session) string {
+	return fmt.Sprintf("%s files (%s) from %s", format.Count(s.Files), format.Bytes(s.Size), s.Peer)
+}
+
+func (rcv *Receiver) error(err error, msg string) {
+	if rcv.Error != nil {
+		rcv.Error(err, msg)
+	}
+}
+
+func (rcv *Receiver) info(msg string) {
+	if rcv.Info != nil {
+		rcv.Info(msg)
+	}
+}
+
+func (rcv *Receiver) verbose(msg string) {
+	if rcv.Verbose != nil {
+		rcv.Verbose(msg)
+	}
+}
+
+//how long a trusted name gets to resolve before its passed over
+var TRUST_LOOKUP_TIMEOUT = 2 * time.Second
+
+func strip_zone(address string) string {
+	if i := strings.IndexByte(address, '%'); i != -1 {
+		return address[:i]
+	}
+	return address
+}
+
+func (rcv *Receiver) is_trusted(ctx context.Context, s Session) bool {
+	//the name a sender reports is its own claim, only the address the link says it came from counts
+	//so a trusted name has to resolve to that address, through the hosts file or mdns
+	remote := net.ParseIP(strip_zone(s.Address))
+	if remote == nil {
+		return false
+	}
+	for _, peer := range rcv.Trusted {
+		if ip := net.ParseIP(strip_zone(peer)); ip != nil {
+			if ip.Equal(remote) {
+				return true
+			}
+			continue
+		}
+
+		lookup, cancel := context.WithTimeout(ctx, TRUST_LOOKUP_TIMEOUT)
+		addresses, err := net.DefaultResolver.LookupIPAddr(lookup, peer)
+		cancel()
+		if err != nil {
+			rcv.verbose(fmt.Sprintf("trusted name %s doesnt resolve: %s", peer, ErrorMessage(err)))
+			continue
+		}
+		for _, a := range addresses {
+			if a.IP.Equal(remote) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (rcv *Receiver) accept_session(ctx context.Context, s Session) string {
+	if rcv.AutoAccept || rcv.is_trusted(ctx, s) {
+		return ""
+	}
+	if rcv.Prompt != nil && rcv.Prompt(s) {
+		return ""
+	}
+	return "declined"
+}
+
+//a session the link cut off, the sender may still come back and carry on with it
+type dropped_error struct {
+	err error
+}
+
+func (e *dropped_error) Error() string {
+	return e.err.Error()
+}
+
+func (e *dropped_error) Unwrap() error {
+	return e.err
+}
+
+func (rcv *Receiver) is_reconnect(token [16]byte, peer string) bool {
+	if token == ([16]byte{}) {
+		return false
+	}
+
+	rcv.guard.Lock()
+	defer rcv.guard.Unlock()
+	for t, a := range rcv.accepted {
+		if time.Since(a.at) > RESUME_WINDOW {
+			delete(rcv.accepted, t)
+			rcv.remove_partials(a)
+		}
+	}
+	a, ok := rcv.accepted[token]
+	return ok && a.peer == peer
+}
+
+func (rcv *Receiver) remember(token [16]byte, peer string) {
+	if token == ([16]byte{}) {
+		return
+	}
+
+	rcv.guard.Lock()
+	defer rcv.guard.Unlock()
+	if rcv.accepted == nil {
+		rcv.accepted = make(map[[16]byte]accepted_session)
+	}
+	a, ok := rcv.accepted[token]
+	if !ok {
+		a.arrived = make(map[string]bool)
+		a.partials = make(map[string]bool)
+	}
+	//its back for its parts
+	if a.expiry != nil {
+		a.expiry.Stop()
+	}
+	a.peer, a.at = peer, time.Now()
+	rcv.accepted[token] = a
+}
+
+//whether a file already arrived over an earlier link of the session, the ack went down with that link
+func (rcv *Receiver) arrived(token [16]byte, name string) (again bool) {
+	if token == ([16]byte{}) {
+		return false
+	}
+
+	rcv.guard.Lock()
+	defer rcv.guard.Unlock()
+	a, ok := rcv.accepted[token]
+	if !ok {
+		return false
+	}
+	again = a.arrived[name]
+	a.arrived[name] = true
+	return again
+}
+
+//a part kept after a file was cut off is only worth anything while its sender can come back for it
+func (rcv *Receiver) keep_partial(token [16]byte, path string) {
+	_, err := os.Lstat(path + PARTIAL_SUFFIX)
+
+	rcv.guard.Lock()
+	defer rcv.guard.Unlock()
+	a, ok := rcv.accepted[token]
+	switch {
+	case err != nil:
+		//it arrived or was given up on
+		if ok {
+			delete(a.partials, path)
+		}
+	case !ok:
+		//theres no session to come back to
+		os.Remove(path + PARTIAL_SUFFIX)
+	default:
+		//the window starts again from when the link went
+		a.partials[path] = true
+		a.at = time.Now()
+		if a.expiry != nil {
+			a.expiry.Stop()
+		}
+		a.expiry = time.AfterFunc(RESUME_WINDOW, func() {
+			rcv.expire(token)
+		})
+		rcv.accepted[token] = a
+	}
+}
+
+func (rcv *Receiver) expire(token [16]byte) {
+	rcv.guard.Lock()
+	defer rcv.guard.Unlock()
+	a, ok := rcv.accepted[token]
+	if !ok || time.Since(a.at) < RESUME_WINDOW {
+		return
+	}
+	delete(rcv.accepted, token)
+	rcv.remove_partials(a)
+}
+
+//called with the guard held
+func (rcv *Receiver) remove_partials(a accepted_session) {
+	for path := range a.partials {
+		//a link that picked it up again has it open, its left to that link
+		if _, busy := rcv.writing[path]; !busy {
+			os.Remove(path + PARTIAL_SUFFIX)
+		}
+		delete(a.partials, path)
+	}
+}
+
+func (rcv *Receiver) hold(ctx context.Context, path string) (release func(), err error) {
+	for {
+		rcv.guard.Lock()
+		busy, ok := rcv.writing[path]
+		if !ok {
+			if rcv.writing == nil {
+				rcv.writing = make(map[string]chan bool)
+			}
+			done := make(chan bool)
+			rcv.writing[path] = done
+			rcv.guard.Unlock()
+			return func() {
+				rcv.guard.Lock()
+				delete(rcv.writing, path)
+				rcv.guard.Unlock()
+				close(done)
+			}, nil
+		}
+		rcv.guard.Unlock()
+
+		select {
+		case <-busy:
+		case <-ctx.Done():
+			return nil, ERR_INTERRUPTED
+		}
+	}
+}
+
+func (rcv *Receiver) check_session(s Session) string {
+	if rcv.MaxFiles != 0 && s.Files > rcv.MaxFiles {
+		return fmt.Sprintf("too many files (%s, limit is %s)", format.Count(s.Files), format.Count(rcv.MaxFiles))
+	}
+	if rcv.MaxBytes != 0 && s.Size > rcv.MaxBytes {
+		return fmt.Sprintf("too large (%s, limit is %s)", format.Bytes(s.Size), format.Bytes(rcv.MaxBytes))
+	}
+	return ""
+}
+
+//checked before anyone is asked, and again when reserving since other sessions may have taken the room meanwhile
+func (rcv *Receiver) has_room(s Session) string {
+	rcv.guard.Lock()
+	defer rcv.guard.Unlock()
+	return rcv.room(s)
+}
+
+func (rcv *Receiver) room(s Session) string {
+	if rcv.MaxTotalFiles != 0 && rcv.reserved_files+s.Files > rcv.MaxTotalFiles {
+		return fmt.Sprintf("receiver file limit reached (%s left)", format.Count(rcv.MaxTotalFiles-rcv.reserved_files))
+	}
+	if rcv.MaxTotalBytes != 0 && rcv.reserved_bytes+s.Size > rcv.MaxTotalBytes {
+		return fmt.Sprintf("receiver size limit reached (%s left)", format.Bytes(rcv.MaxTotalBytes-rcv.reserved_bytes))
+	}
+
+	//other sessions may still be writing into the same space
+	if free, err := free_space(rcv.root()); err == nil {
+		if rcv.pending_bytes+s.Size > int64(free) {
+			return fmt.Sprintf("not enough disk space (need %s, %s free)", format.Bytes(s.Size), format.Bytes(int64(free)-rcv.pending_bytes))
+		}
+	}
+	return ""
+}
+
+func (rcv *Receiver) reserve_session(s Session) string {
+	rcv.guard.Lock()
+	defer rcv.guard.Unlock()
+
+	if refusal := rcv.room(s); refusal != "" {
+		return refusal
+	}
+	rcv.reserved_files += s.Files
+	rcv.reserved_bytes += s.Size
+	rcv.pending_bytes += s.Size
+
+	return ""
+}
+
+func (rcv *Receiver) release_session(s *session) {
+	//only what actually arrived counts towards the run limits
+	rcv.guard.Lock()
+	defer rcv.guard.Unlock()
+
+	rcv.reserved_files -= s.Files - s.received_files
+	rcv.reserved_bytes -= s.Size - s.received_bytes
+	rcv.pending_bytes -= s.Size
+}
+
+func (s *session) consume(t transfer) error {
+	if s.received_files+s.skipped_files+s.failed_files+1 > s.Files || s.received_bytes+t.size > s.Size {
+		return fmt.Errorf("peer sent more than it announced")
+	}
+
+	s.received_files++
+	s.received_bytes += t.size
+	return nil
+}
+
+func (s *session) unconsume(t transfer) {
+	//it never arrived after all
+	s.received_files--
+	s.received_bytes -= t.size
+}
+
+func (rcv *Receiver) root() string {
+	if rcv.Root == "" {
+		return "."
+	}
+	return rcv.Root
+}
+
+func remote_address(conn net.Conn) string {
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return a.IP.String()
+	}
+	return conn.RemoteAddr().String()
+}
+
+func (rcv *Receiver) receive_all(ctx context.Context, conn net.Conn, started func()) (bool, error) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	//nothing to clean up until the session is accepted
+	stop := close_on_cancel(ctx, conn)
+	defer stop()
+
+	t, err := from_wire(reader)
+	if err != nil {
+		//nothing was sent
+		return false, nil
+	}
+
+	//listings are answered without touching the transfer display
+	switch t.kind {
+	case protocol.KIND_LIST:
+		return false, rcv.serve_listing(conn, t)
+	case protocol.KIND_SESSION:
+	default:
+		rcv.error(nil, "unexpected message, is the peer up to date?")
+		return false, fmt.Errorf("unexpected message")
+	}
+
+	payload, err := protocol.ReadPayload(reader, t.header())
+	if err != nil {
+		rcv.error(err, "FAIL")
+		return false, err
+	}
+	announced, err := protocol.ParseSession(t.name, payload)
+	if err != nil {
+		rcv.error(err, "FAIL")
+		return false, err
+	}
+
+	var s session
+	s.Session = Session{Peer: announced.Name, Address: remote_address(conn), Files: announced.Files, Size: announced.Size, Top: announced.Top, More: announced.More, Durable: announced.Durable}
+
+	writer := bufio.NewWriter(conn)
+	//nobody is asked about a session that would be turned away anyway
+	refusal := rcv.check_session(s.Session)
+	if refusal == "" {
+		refusal = rcv.has_room(s.Session)
+	}
+	if refusal == "" {
+		if rcv.is_reconnect(announced.Token, s.Peer) {
+			rcv.verbose(fmt.Sprintf("%s reconnected", s.Peer))
+		} else {
+			refusal = rcv.accept_session(ctx, s.Session)
+		}
+	}
+	if refusal == "" {
+		refusal = rcv.reserve_session(s.Session)
+	}
+	if refusal != "" {
+		protocol.WriteMessage(writer, protocol.KIND_REJECT, refusal, nil)
+		writer.Flush()
+		rcv.info(fmt.Sprintf("rejected %s: %s", Describe(s.Session), refusal))
+		return false, nil
+	}
+	rcv.remember(announced.Token, s.Peer)
+	defer rcv.release_session(&s)
+
+	protocol.WriteMessage(writer, protocol.KIND_ACCEPT, protocol.Hostname(), nil)
+	if err = writer.Flush(); err != nil {
+		rcv.error(err, "FAIL")
+		return false, err
+	}
+	stop()
+
+	started()
+
+	//tell the sender why before the link goes away
+	c := &control{writer: writer}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetWriteDeadline(time.Now().Add(ABORT_TIMEOUT))
+			c.send(protocol.KIND_ABORT, "receiver interrupted", nil)
+			half_close(conn)
+			conn.SetReadDeadline(time.Now().Add(ABORT_TIMEOUT))
+		case <-done:
+		}
+	}()
+
+	var d Events = no_events{}
+	if rcv.Events != nil {
+		d = events_or_nothing(rcv.Events())
+	}
+
+	rcv.guard.Lock()
+	rcv.sessions++
+	s.ID = rcv.sessions
+	rcv.guard.Unlock()
+	d.SessionStart(s.Session)
+
+	//the last update of the file being written, its reported again once its on the disk
+	var last File
+	display := func(t transfer) {
+		last = t.file()
+		d.File(last)
+	}
+
+	var r Summary
+	r.Total = s.Files
+	r.Skipped = make([]Failure, 0)
+	r.Failed = make([]Failure, 0)
+	start := Now()
+
+	//we ended it on purpose, the sender was told and wont be back
+	refused := false
+
+	for {
+		if _, err = reader.Peek(1); err != nil {
+			break
+		}
+
+		if t, err = from_wire(reader); err != nil {
+			var header *protocol.HeaderError
+			if !errors.As(err, &header) {
+				break
+			}
+			if !header.Whole {
+				//theres no telling where the next header starts
+				rcv.abort(conn, reader, c, err)
+				refused = true
+				break
+			}
+
+			//a name we wont write, only this file is lost
+			s.failed_files++
+			r.Failed = append(r.Failed, Failure{t.name, err})
+			d.FileError(t.name, err)
+			if err = c.send(protocol.KIND_FAILED, t.name, reason(err)); err != nil {
+				break
+			}
+			//a resume waits for its offset so nothing follows it, the sender cancels it instead
+			if t.kind == protocol.KIND_FILE {
+				var cancelled *CancelError
+				frames := &frame_reader{ctx: ctx, reader: reader}
+				if err = frames.discard(t.size); err != nil && !errors.As(err, &cancelled) {
+					break
+				}
+			}
+			err = nil
+			continue
+		}
+
+		if t.kind == protocol.KIND_SKIP {
+			//the sender couldnt read this one
+			s.skipped_files++
+			r.Skipped = append(r.Skipped, Failure{t.name, fmt.Errorf("skipped by sender")})
+			d.FileError(t.name, fmt.Errorf("skipped by sender"))
+			continue
+		}
+
+		if t.kind == protocol.KIND_ABORT {
+			err = &AbortError{t.name}
+			break
+		}
+
+		if t.kind == protocol.KIND_CANCEL {
+			//a cancel that crossed with the end of its file
+			if _, err = protocol.ReadPayload(reader, t.header()); err != nil {
+				break
+			}
+			continue
+		}
+
+		if t.kind != protocol.KIND_FILE && t.kind != protocol.KIND_RESUME {
+			err = fmt.Errorf("unexpected message")
+			rcv.abort(conn, reader, c, err)
+			refused = true
+			break
+		}
+
+		//the limits were checked against the announcement, hold the sender to it
+		if err = s.consume(t); err != nil {
+			rcv.abort(conn, reader, c, err)
+			refused = true
+			break
+		}
+		t.number = int(s.received_files)
+		t.limit = rcv.Limit
+		t.path = filepath.Join(rcv.root(), t.name)
+
+		var release func()
+		if release, err = rcv.hold(ctx, t.path); err != nil {
+			break
+		}
+
+		if t.kind == protocol.KIND_RESUME {
+			//the link dropped partway through this one before, say how much of it is here
+			if t.resumed = partial_size(t.path); t.resumed > t.size {
+				t.resumed = 0
+			}
+			t.progress = t.resumed
+			offset := make([]byte, 8)
+			binary.BigEndian.PutUint64(offset, uint64(t.resumed))
+			if err = c.send(protocol.KIND_OFFSET, filepath.ToSlash(t.name), offset); err != nil {
+				release()
+				break
+			}
+		}
+
+		frames := &frame_reader{ctx: ctx, reader: reader}
+		var sum []byte
+		sum, err = to_disk(ctx, frames, t, rcv.Fsync || s.Durable, display)
+		rcv.keep_partial(announced.Token, t.path)
+		release()
+		if err == nil && frames.left != 0 {
+			err = fmt.Errorf("data misaligned")
+		}
+
+		var aborted *AbortError
+		var cancelled *CancelError
+		var local *local_error
+		switch {
+		case err == nil:
+			//counted once over the whole session, not once per link
+			if rcv.arrived(announced.Token, t.name) {
+				r.Total--
+			} else {
+				r.Files++
+				r.Bytes += t.size
+			}
+			d.FileDone(last)
+			//the sender only counts it once it hears this
+			if err = c.send(protocol.KIND_ACK, filepath.ToSlash(t.name), sum); err == nil {
+				continue
+			}
+		case errors.As(err, &aborted) || ctx.Err() != nil:
+			//the partial file is gone, the session error says why
+		case errors.As(err, &cancelled):
+			//the sender couldnt finish reading it
+			s.unconsume(t)
+			s.skipped_files++
+			r.Skipped = append(r.Skipped, Failure{t.name, err})
+			d.FileError(t.name, err)
+			err = nil
+			continue
+		case errors.As(err, &local) && !is_disk_full(err):
+			//only this file is lost, let the sender know and skip the rest of it
+			s.unconsume(t)
+			s.failed_files++
+			r.Failed = append(r.Failed, Failure{t.name, err})
+			d.FileError(t.name, err)
+			if err = c.send(protocol.KIND_FAILED, filepath.ToSlash(t.name), reason(err)); err != nil {
+				break
+			}
+			if err = frames.discard(t.size); err == nil || errors.As(err, &cancelled) {
+				err = nil
+				continue
+			}
+		default:
+			r.Failed = append(r.Failed, Failure{t.name, err})
+			d.FileError(t.name, err)
+			rcv.abort(conn, reader, c, err)
+		}
+		break
+	}
+
+	//the link went before every file was answered for, rather than anyone ending it
+	cut := false
+	if ctx.Err() != nil {
+		err = ERR_INTERRUPTED
+		//keep reading until the sender hangs up so our abort isnt lost to a reset
+		io.Copy(io.Discard, reader)
+	} else if err == io.EOF {
+		err = nil
+		if s.received_files+s.skipped_files+s.failed_files != s.Files {
+			err = fmt.Errorf("session ended after %s of %s files", format.Count(s.received_files), format.Count(s.Files))
+			cut = true
+		} else if s.failed_files != 0 {
+			err = fmt.Errorf("%s of %s files failed", format.Count(s.failed_files), format.Count(s.Files))
+		} else if s.skipped_files != 0 {
+			err = fmt.Errorf("%s of %s files skipped by sender", format.Count(s.skipped_files), format.Count(s.Files))
+		}
+	} else if err != nil {
+		cut = !refused && resumable(ctx, err)
+	}
+
+	r.Err = err
+	r.Elapsed = float64(Now()-start) / 1000000.0
+	d.SessionDone(r)
+
+	if cut && announced.Token != ([16]byte{}) {
+		return true, &dropped_error{err}
+	}
+	return true, err
+}
+
+func (rcv *Receiver) abort(conn net.Conn, reader io.Reader, c *control, err error) {
+	//the sender would otherwise only see the link drop
+	conn.SetWriteDeadline(time.Now().Add(ABORT_TIMEOUT))
+	c.send(protocol.KIND_ABORT, string(reason(err)), nil)
+	half_close(conn)
+	conn.SetReadDeadline(time.Now().Add(ABORT_TIMEOUT))
+	io.Copy(io.Discard, reader)
+}
+
+func (rcv *Receiver) resume_wait() time.Duration {
+	if rcv.ResumeWait <= 0 {
+		return RESUME_WAIT
+	}
+	return rcv.ResumeWait
+}
+
+func (rcv *Receiver) Serve(ctx context.Context) error {
+	ln, err := transport_or_tcp(rcv.Transport).Listen(rcv.Local)
+	if err != nil {
+		return fmt.Errorf("listening failed: %w", err)
+	}
+	defer ln.Close()
+
+	//nobody can come back for a part once were not listening
+	defer func() {
+		rcv.guard.Lock()
+		defer rcv.guard.Unlock()
+		for _, a := range rcv.accepted {
+			rcv.remove_partials(a)
+		}
+	}()
+
+	//sessions still running when we return are cut off
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	started := make(chan bool)
+	finished := make(chan error)
+
+	//closed once nobody is counting sessions any more
+	gone := make(chan bool)
+	defer close(gone)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				rcv.error(err, "accepting failed")
+				continue
+			}
+			rcv.verbose(fmt.Sprintf("connection from %s", conn.RemoteAddr()))
+
+			go func() {
+				accepted, err := rcv.receive_all(ctx, conn, func() {
+					select {
+					case started <- true:
+					case <-gone:
+					}
+				})
+				if accepted {
+					select {
+					case finished <- err:
+					case <-gone:
+					}
+				}
+			}()
+		}
+	}()
+
+	//the timeout only runs while no session is active
+	active := 0
+	received := 0
+	failed := 0
+
+	//with once, a dropped session doesnt count until its sender has had the chance to come back
+	var dropped error
+	var resume <-chan time.Time
+	var idle *time.Timer
+	var timeout <-chan time.Time
+	if rcv.Timeout != 0 {
+		idle = time.NewTimer(rcv.Timeout)
+		timeout = idle.C
+	}
+
+	err = func() error {
+		for {
+			select {
+			case <-started:
+				active++
+				if idle != nil && !idle.Stop() && active == 1 {
+					<-idle.C
+				}
+				continue
+			case err := <-finished:
+				active--
+				var cut *dropped_error
+				if rcv.Once && errors.As(err, &cut) {
+					dropped = err
+					resume = time.After(rcv.resume_wait())
+					break
+				}
+				received++
+				if err != nil {
+					failed++
+				}
+			case <-resume:
+				resume = nil
+				if active == 0 {
+					return dropped
+				}
+				continue
+			case <-timeout:
+				if received == 0 && dropped != nil {
+					return dropped
+				}
+				if received == 0 {
+					return ERR_TIMEOUT
+				}
+				if failed != 0 {
+					return fmt.Errorf("%d of %d sessions failed", failed, received)
+				}
+				return nil
+			case <-ctx.Done():
+				return ERR_INTERRUPTED
+			}
+
+			if rcv.Once && received != 0 {
+				if failed != 0 {
+					return fmt.Errorf("session failed")
+				}
+				return nil
+			}
+
+			if idle != nil && active == 0 {
+				idle.Reset(rcv.Timeout)
+			}
+		}
+	}()
+
+	//give whatever is still running a moment to tell its peer and clean up
+	cancel()
+	wait := time.After(2 * ABORT_TIMEOUT)
+	for active > 0 {
+		select {
+		case <-started:
+			active++
+		case <-finished:
+			active--
+		case <-wait:
+			return err
+		}
+	}
+
+	return err
+}
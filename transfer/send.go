@@ -0,0 +1,917 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"wire/protocol"
+)
+
+//at most this many top-level names are announced, the rest are just counted
+var SESSION_NAMES = 32
+
+var ERR_SKIPPED = fmt.Errorf("nothing sent, some files couldnt be read")
+
+var ERR_UNACKNOWLEDGED = fmt.Errorf("not acknowledged by receiver")
+
+var ERR_MISMATCH = fmt.Errorf("checksum mismatch, receiver wrote something else")
+
+//syncing a big file to a slow disk can take a while
+var ACK_TIMEOUT = time.Minute
+
+//the wait between reconnects doubles up to this
+var MAX_BACKOFF = 30 * time.Second
+
+type queue struct {
+	pending []*transfer
+	total   int
+	size    int64
+
+	//anything that couldnt be queued, reported at the end
+	skipped []Failure
+
+	//every folder walked, parents before children
+	folders []string
+
+	//files and folders left out by the filter
+	filter   *walk_filter
+	filtered int64
+
+	//how names are made, see Sender
+	base    string
+	flatten bool
+	strip   int
+	names   map[string]bool
+
+	//where the path being queued goes on the receiver
+	prefix string
+}
+
+func new_queue(filter *Filter) queue {
+	var q queue
+	q.pending = make([]*transfer, 0)
+	q.filter = new_walk_filter(filter)
+	q.names = make(map[string]bool)
+	return q
+}
+
+func (q *queue) name(path, name string) (string, error) {
+	switch {
+	case q.flatten:
+		name = filepath.Base(path)
+	case q.base != "":
+		absolute, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		name, err = filepath.Rel(q.base, absolute)
+		if err != nil || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("outside %s", q.base)
+		}
+	}
+
+	if q.strip != 0 {
+		parts := strings.Split(filepath.ToSlash(name), "/")
+		if len(parts) <= q.strip {
+			return "", fmt.Errorf("nothing left after stripping %d folders", q.strip)
+		}
+		name = filepath.Join(parts[q.strip:]...)
+	}
+	if q.prefix != "" {
+		name = filepath.Join(q.prefix, name)
+	}
+
+	//the receiver answers for a file under the name it understood, which has to be the name we sent
+	name, err := protocol.SanitizeName(name)
+	if err != nil {
+		return "", err
+	}
+
+	if q.flatten {
+		//everything lands in the same folder so names can collide
+		if q.names[name] {
+			return "", fmt.Errorf("another file is already sent as %s", filepath.ToSlash(name))
+		}
+		q.names[name] = true
+	}
+	return name, nil
+}
+
+func split_destination(arg string) (source, destination string) {
+	//SRC:DEST, unless the whole thing is a path that exists
+	if _, err := os.Stat(arg); err == nil {
+		return arg, ""
+	}
+	i := strings.LastIndex(arg, ":")
+	if i <= 0 || (i == 1 && runtime.GOOS == "windows") {
+		//no colon, or just a drive letter
+		return arg, ""
+	}
+	return arg[:i], arg[i+1:]
+}
+
+func (q *queue) enqueue_transfer(t *transfer) {
+	q.total++
+	t.number = q.total
+	q.size += t.size
+	q.pending = append(q.pending, t)
+}
+
+func (q *queue) enqueue_folder(folder string) error {
+	parent := filepath.Dir(folder)
+	//the folder is compared against the parents of whats in it, a trailing slash would never match
+	folder = filepath.Clean(folder)
+	//ignore files from another folder dont apply here
+	q.filter.ignored = nil
+	err := filepath.WalkDir(folder, func(path string, info os.DirEntry, err error) error {
+		if err != nil {
+			//skip whatever is unreadable but keep walking
+			q.skipped = append(q.skipped, Failure{path, err})
+			return nil
+		}
+
+		//filters see names relative to the folder being sent
+		relative, _ := filepath.Rel(folder, path)
+		relative = filepath.ToSlash(relative)
+		if relative != "." && q.filter.skip(relative, info.IsDir()) {
+			q.filtered++
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			q.folders = append(q.folders, path)
+			if relative == "." {
+				relative = ""
+			}
+			q.filter.read_ignores(path, relative)
+		} else {
+			name, _ := filepath.Rel(parent, path)
+			name, err := q.name(path, name)
+			if err != nil {
+				q.skipped = append(q.skipped, Failure{path, err})
+				return nil
+			}
+
+			t, err := from_file(path, name)
+			if err != nil {
+				q.skipped = append(q.skipped, Failure{path, err})
+				return nil
+			}
+			q.enqueue_transfer(&t)
+		}
+		return nil
+	})
+
+	return err
+}
+
+func (q *queue) enqueue_path(path string) {
+	//expand any wildcards
+	paths := expand_path(path)
+
+	for _, path := range paths {
+		var i fs.FileInfo
+		i, err := os.Stat(path)
+		if err != nil {
+			//a pattern that matched nothing comes back as itself
+			if os.IsNotExist(err) && strings.ContainsAny(path, "*?[") {
+				err = fmt.Errorf("no files match")
+			}
+			q.skipped = append(q.skipped, Failure{path, err})
+			continue
+		}
+		is_dir := i.IsDir()
+
+		var t transfer
+		if !is_dir {
+			if q.filter.skip(i.Name(), false) {
+				q.filtered++
+				continue
+			}
+			var name string
+			if name, err = q.name(path, i.Name()); err != nil {
+				q.skipped = append(q.skipped, Failure{path, err})
+				continue
+			}
+			if t, err = from_file(path, name); err != nil {
+				q.skipped = append(q.skipped, Failure{path, err})
+				continue
+			}
+			q.enqueue_transfer(&t)
+		} else {
+			q.enqueue_folder(path)
+		}
+	}
+}
+
+func (q *queue) summary() protocol.Session {
+	var s protocol.Session
+	s.Name = protocol.Hostname()
+
+	seen := make(map[string]bool)
+	for _, t := range q.pending {
+		if t.settled {
+			continue
+		}
+		s.Files++
+		s.Size += t.size
+
+		top, _, _ := strings.Cut(t.name, "/")
+		if seen[top] {
+			continue
+		}
+		seen[top] = true
+
+		if len(s.Top) < SESSION_NAMES {
+			s.Top = append(s.Top, top)
+		} else {
+			s.More++
+		}
+	}
+
+	return s
+}
+
+func start_session(reader *bufio.Reader, writer *bufio.Writer, s protocol.Session) (peer string, err error) {
+	//announce what we are about to send and wait for the peer to decide
+	if err = protocol.WriteMessage(writer, protocol.KIND_SESSION, s.Name, s.Build()); err != nil {
+		return "", err
+	}
+	if err = writer.Flush(); err != nil {
+		return "", err
+	}
+
+	t, err := from_wire(reader)
+	if err != nil {
+		return "", fmt.Errorf("link terminated")
+	}
+
+	switch t.kind {
+	case protocol.KIND_ACCEPT:
+		//accepting peers reply with their name
+		return t.name, nil
+	case protocol.KIND_REJECT:
+		return "", &RejectError{t.name}
+	default:
+		return "", fmt.Errorf("unexpected response")
+	}
+}
+
+//the receiver said no, asking again wont change that
+type RejectError struct {
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return "rejected by peer: " + e.Reason
+}
+
+func close_on_cancel(ctx context.Context, conn net.Conn) (stop func()) {
+	//blocked reads and writes only return once the connection goes away
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+//a file the receiver says is on its disk, with the checksum of what it wrote
+type ack struct {
+	name string
+	sum  []byte
+}
+
+//what the receiver made of each file, reported while we carry on sending
+type reports struct {
+	guard  sync.Mutex
+	failed []Failure
+	acked  []ack
+
+	//the file being sent and how to stop it
+	name   string
+	cancel context.CancelFunc
+}
+
+func (r *reports) sending(name string, cancel context.CancelFunc) {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+	r.name = name
+	r.cancel = cancel
+}
+
+func (r *reports) report(name string, err error) {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+	r.failed = append(r.failed, Failure{name, err})
+	if name == r.name && r.cancel != nil {
+		r.cancel()
+	}
+}
+
+func (r *reports) acknowledge(name string, sum []byte) {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+	r.acked = append(r.acked, ack{name, sum})
+}
+
+func (r *reports) take() (failed []Failure, acked []ack) {
+	r.guard.Lock()
+	defer r.guard.Unlock()
+	failed, acked = r.failed, r.acked
+	r.failed, r.acked = nil, nil
+	return failed, acked
+}
+
+type Sender struct {
+	Local string
+
+	//carry on past files that cant be read instead of sending nothing
+	KeepGoing bool
+
+	//remove each source once the receiver has it on its disk and the checksums match
+	Move bool
+
+	//what to leave out of folders, everything is sent when not set
+	Filter *Filter
+
+	//files are named relative to Base when set, or just by their own name when flattened
+	//otherwise files keep their name and folders are sent with everything under them
+	Base    string
+	Flatten bool
+
+	//leading folders dropped from every name, then the rest is put under Prefix
+	//a path given as SRC:DEST goes under DEST instead
+	Strip  int
+	Prefix string
+
+	//shared with anything else that should stay under the same rate
+	Limit *Limiter
+
+	//reconnect up to this many times in a row when the link drops, carrying on where it stopped
+	//waiting Backoff before the first and twice as long each time after
+	Retries int
+	Backoff time.Duration
+
+	//finds the receiver again before reconnecting, the last address is used when not set or when it fails
+	//peer is the name the receiver answered with, empty if it never did
+	Redial func(ctx context.Context, peer string) (string, error)
+
+	Events Events
+
+	//tcp when not set
+	Transport Transport
+}
+
+func (snd *Sender) queue(paths []string) queue {
+	q := new_queue(snd.Filter)
+	q.flatten = snd.Flatten
+	q.strip = snd.Strip
+	if snd.Base != "" {
+		q.base, _ = filepath.Abs(snd.Base)
+	}
+	for _, path := range paths {
+		source, destination := split_destination(path)
+		if destination == "" {
+			destination = snd.Prefix
+		}
+
+		//the receiver checks this too, but its better to find out before sending anything
+		prefix, err := protocol.SanitizeName(destination)
+		if err != nil {
+			q.skipped = append(q.skipped, Failure{path, err})
+			continue
+		}
+		q.prefix = prefix
+		q.enqueue_path(source)
+	}
+	return q
+}
+
+func ReadPaths(reader io.Reader, nul bool) ([]string, error) {
+	//one path per line, or NUL separated like find -print0
+	separator := byte('\n')
+	if nul {
+		separator = 0
+	}
+
+	out := make([]string, 0)
+	buffered := bufio.NewReader(reader)
+	for {
+		path, err := buffered.ReadString(separator)
+		path = strings.TrimSuffix(path, string(separator))
+		if !nul {
+			path = strings.TrimSuffix(path, "\r")
+		}
+		if path != "" {
+			out = append(out, path)
+		}
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+}
+
+//what Send would send, worked out without connecting to anything
+type Plan struct {
+	Files []File
+	Size  int64
+
+	Skipped  []Failure
+	Filtered int64
+}
+
+func (snd *Sender) Plan(paths []string) Plan {
+	q := snd.queue(paths)
+
+	var p Plan
+	p.Files = make([]File, 0, len(q.pending))
+	for _, t := range q.pending {
+		p.Files = append(p.Files, t.file())
+	}
+	p.Size = q.size
+	p.Skipped = q.skipped
+	p.Filtered = q.filtered
+	return p
+}
+
+//a send across however many links it takes
+type sending struct {
+	snd *Sender
+	d   Events
+	q   queue
+	r   Summary
+
+	//tells the receiver a new link is the same session carrying on
+	token [16]byte
+
+	started bool
+	start   int64
+	peer    string
+
+	//the receiver gave up or we did, no point reconnecting after either
+	aborted error
+	stopped bool
+
+	//the file that was on the wire when the last link dropped
+	lost     *transfer
+	lost_err error
+
+	//folders that lost files, pruned at the end if theyre empty
+	emptied map[string]bool
+	walked  map[string]bool
+}
+
+func (snd *Sender) Send(ctx context.Context, remote string, paths []string) error {
+	s := &sending{snd: snd, d: events_or_nothing(snd.Events)}
+	s.q = snd.queue(paths)
+	s.r.Total = int64(s.q.total)
+	s.r.Skipped = s.q.skipped
+	s.r.Filtered = s.q.filtered
+	s.r.Failed = make([]Failure, 0)
+
+	if len(s.q.skipped) != 0 && !snd.KeepGoing {
+		s.r.Err = ERR_SKIPPED
+		s.d.SessionDone(s.r)
+		return s.r.Err
+	}
+
+	s.emptied = make(map[string]bool)
+	s.walked = make(map[string]bool)
+	for _, folder := range s.q.folders {
+		s.walked[folder] = true
+	}
+	rand.Read(s.token[:])
+
+	backoff := snd.backoff()
+	failures := 0
+	var err error
+	for {
+		var progress, retry bool
+		progress, retry, err = s.attempt(ctx, remote)
+		if err == nil || !retry || ctx.Err() != nil {
+			break
+		}
+
+		//the budget is for links that go nowhere, one that moved data starts it over
+		if progress {
+			failures = 0
+			backoff = snd.backoff()
+		}
+		failures++
+		if failures > snd.Retries {
+			break
+		}
+
+		s.d.Reconnecting(failures, snd.Retries, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if backoff *= 2; backoff > MAX_BACKOFF {
+			backoff = MAX_BACKOFF
+		}
+
+		//the receiver might be somewhere else now
+		if snd.Redial != nil {
+			if address, err := snd.Redial(ctx, s.peer); err == nil {
+				remote = address
+			}
+		}
+	}
+
+	//even a receiver that was never reached gets a summary saying why
+	return s.finish(ctx, err)
+}
+
+func (snd *Sender) backoff() time.Duration {
+	if snd.Backoff <= 0 {
+		return time.Second
+	}
+	return snd.Backoff
+}
+
+func (s *sending) attempt(ctx context.Context, remote string) (progress, retry bool, err error) {
+	snd, d, q, r := s.snd, s.d, &s.q, &s.r
+
+	conn, err := transport_or_tcp(snd.Transport).Dial(ctx, snd.Local, remote)
+	if err != nil {
+		return false, true, fmt.Errorf("dial failed: %w", err)
+	}
+	defer conn.Close()
+	s.lost, s.lost_err = nil, nil
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	//only whats left is announced again
+	announced := q.summary()
+	announced.Durable = snd.Move
+	announced.Token = s.token
+	stop := close_on_cancel(ctx, conn)
+	peer, err := start_session(reader, writer, announced)
+	stop()
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, false, ERR_INTERRUPTED
+		}
+		var rejected *RejectError
+		return false, !errors.As(err, &rejected), err
+	}
+
+	//from here on the session is described from our side, the peer is the receiver
+	if !s.started {
+		s.started = true
+		s.start = Now()
+		s.peer = peer
+		d.SessionStart(Session{ID: 1, Peer: peer, Address: remote, Files: announced.Files, Size: announced.Size, Top: announced.Top, More: announced.More, Durable: announced.Durable})
+	}
+
+	session, cancel := context.WithCancel(ctx)
+	defer cancel()
+	deadline_on_cancel(session, conn)
+
+	//the receiver can give up at any point, listen for it while sending
+	aborted := make(chan error, 1)
+	watched := make(chan bool)
+	answered := make(chan bool, 1)
+	offsets := make(chan int64, 1)
+	var failures reports
+	go func() {
+		defer close(watched)
+		for {
+			t, err := from_wire(reader)
+			if err != nil {
+				return
+			}
+			switch t.kind {
+			case protocol.KIND_ABORT:
+				aborted <- &AbortError{t.name}
+				cancel()
+				return
+			case protocol.KIND_FAILED:
+				payload, err := protocol.ReadPayload(reader, t.header())
+				if err != nil {
+					return
+				}
+				failures.report(t.name, fmt.Errorf("receiver: %s", payload))
+			case protocol.KIND_ACK:
+				payload, err := protocol.ReadPayload(reader, t.header())
+				if err != nil {
+					return
+				}
+				failures.acknowledge(t.name, payload)
+			case protocol.KIND_OFFSET:
+				payload, err := protocol.ReadPayload(reader, t.header())
+				if err != nil || len(payload) != 8 {
+					return
+				}
+				select {
+				case offsets <- int64(binary.BigEndian.Uint64(payload)):
+				case <-session.Done():
+					return
+				}
+			}
+			select {
+			case answered <- true:
+			default:
+			}
+		}
+	}()
+
+	//files are only done once the receiver says theyre on its disk
+	awaiting := make([]*transfer, 0)
+	answer := func(name string) *transfer {
+		for i, t := range awaiting {
+			if t.name == name {
+				awaiting = append(awaiting[:i], awaiting[i+1:]...)
+				t.settled = true
+				return t
+			}
+		}
+		return nil
+	}
+	//files we cancelled ourselves are already counted as failed
+	cancelled_here := make(map[string]bool)
+	merge := func() {
+		failed, acked := failures.take()
+		for _, a := range acked {
+			t := answer(a.name)
+			if t == nil {
+				continue
+			}
+			progress = true
+			if !bytes.Equal(a.sum, t.sum) {
+				r.Failed = append(r.Failed, Failure{t.name, ERR_MISMATCH})
+				d.FileError(t.name, ERR_MISMATCH)
+				continue
+			}
+			r.Files++
+			r.Bytes += t.size
+			d.FileDone(t.file())
+
+			if !snd.Move {
+				continue
+			}
+			if err := os.Remove(t.path); err != nil {
+				err = fmt.Errorf("sent but not removed: %w", err)
+				r.Failed = append(r.Failed, Failure{t.name, err})
+				d.FileError(t.name, err)
+				continue
+			}
+			for dir := filepath.Dir(t.path); s.walked[dir] && !s.emptied[dir]; dir = filepath.Dir(dir) {
+				s.emptied[dir] = true
+			}
+		}
+		for _, f := range failed {
+			answer(f.Name)
+			if cancelled_here[f.Name] {
+				continue
+			}
+			r.Failed = append(r.Failed, f)
+			d.FileError(f.Name, f.Err)
+		}
+	}
+
+	//the last update of the file being sent, its reported again once its acknowledged
+	//earlier files are answered for as it goes so theyre not held up behind it
+	var last File
+	display := func(t transfer) {
+		if t.progress > t.resumed {
+			progress = true
+		}
+		last = t.file()
+		d.File(last)
+		merge()
+	}
+
+	//set when the link dropped under us rather than anyone deciding to stop
+	lost := false
+
+	for _, p := range q.pending {
+		if p.settled {
+			continue
+		}
+		merge()
+		if session.Err() != nil {
+			break
+		}
+
+		var file *os.File
+		if file, err = open_file_for_reading(p.path); err != nil {
+			//nothing has been written for this file yet so the link is still usable
+			p.settled = true
+			r.Failed = append(r.Failed, Failure{p.name, err})
+			d.FileError(p.name, err)
+			if err = protocol.WriteMessage(writer, protocol.KIND_SKIP, p.name, nil); err != nil {
+				lost = true
+				break
+			}
+			if snd.KeepGoing {
+				continue
+			}
+			s.stopped = true
+			break
+		}
+
+		//a file thats been started before is picked up from whatever the receiver has of it
+		p.limit = snd.Limit
+		p.resumed, p.progress = 0, 0
+		if p.begun {
+			//chunks read for the dropped link are still sitting in the old channel
+			p.kind = protocol.KIND_RESUME
+			p.data = make(chan []byte, cap(p.data))
+		}
+		p.begun = true
+
+		file_ctx, cancel_file := context.WithCancel(session)
+		failures.sending(p.name, cancel_file)
+		if err = protocol.WriteBuffer(writer, p.header().Build()); err == nil && p.kind == protocol.KIND_RESUME {
+			err = writer.Flush()
+			if err == nil {
+				select {
+				case offset := <-offsets:
+					p.resumed, p.progress = offset, offset
+					if offset < 0 || offset > p.size {
+						err = fmt.Errorf("invalid offset")
+					}
+				case <-watched:
+					err = fmt.Errorf("link terminated")
+				case <-file_ctx.Done():
+					err = ERR_INTERRUPTED
+				}
+			}
+		}
+		if err == nil {
+			p.sum, err = to_wire(file_ctx, writer, file, *p, display)
+		}
+		failures.sending("", nil)
+		cancelled := file_ctx.Err() != nil
+		cancel_file()
+		file.Close()
+
+		var local *local_error
+		switch {
+		case session.Err() != nil:
+		case err == nil:
+			writer.Flush()
+			p.start, p.progress = last.Start, p.size
+			awaiting = append(awaiting, p)
+			continue
+		case cancelled:
+			//the receiver already gave up on this one and is skipping the rest of it
+			p.settled = true
+			if err = protocol.WriteMessage(writer, protocol.KIND_CANCEL, p.name, []byte("failed on receiver")); err == nil {
+				continue
+			}
+			lost = true
+		case errors.As(err, &local):
+			//the data stopped between frames so only this file is lost
+			p.settled = true
+			r.Failed = append(r.Failed, Failure{p.name, err})
+			d.FileError(p.name, err)
+			cancelled_here[p.name] = true
+			if err = protocol.WriteMessage(writer, protocol.KIND_CANCEL, p.name, reason(err)); err != nil {
+				lost = true
+				break
+			}
+			if snd.KeepGoing {
+				continue
+			}
+			s.stopped = true
+		default:
+			//a broken link is often the receiver giving up, give it a chance to say why
+			conn.SetReadDeadline(time.Now().Add(ABORT_TIMEOUT))
+			<-watched
+			if session.Err() == nil {
+				lost = true
+				s.lost, s.lost_err = p, err
+			}
+		}
+		break
+	}
+
+	if !lost {
+		if ctx.Err() != nil {
+			//the pipeline stopped between chunks so the receiver can still make sense of this
+			protocol.WriteMessage(writer, protocol.KIND_ABORT, "sender interrupted", nil)
+		} else if s.stopped {
+			protocol.WriteMessage(writer, protocol.KIND_ABORT, "sender stopped after a failed file", nil)
+		}
+		writer.Flush()
+
+		//hold the link open until every file is answered for
+		merge()
+		idle := time.NewTimer(ACK_TIMEOUT)
+		defer idle.Stop()
+	waiting:
+		for len(awaiting) != 0 && session.Err() == nil {
+			select {
+			case <-answered:
+				merge()
+				idle.Reset(ACK_TIMEOUT)
+			case <-watched:
+				//whatever hasnt been answered for is sent again over the next link
+				merge()
+				lost = len(awaiting) != 0 && session.Err() == nil
+				if lost {
+					err = fmt.Errorf("link terminated")
+				}
+				break waiting
+			case <-idle.C:
+				break waiting
+			}
+		}
+	}
+
+	//wait for the receiver to finish up, or to say why it didnt
+	half_close(conn)
+	select {
+	case <-watched:
+	case <-time.After(ABORT_TIMEOUT):
+	}
+	merge()
+
+	select {
+	case s.aborted = <-aborted:
+		return progress, false, s.aborted
+	default:
+	}
+	if lost && ctx.Err() == nil && !s.stopped {
+		return progress, true, err
+	}
+	return progress, false, nil
+}
+
+func (s *sending) finish(ctx context.Context, err error) error {
+	r, d := &s.r, s.d
+
+	//anything started and never acknowledged, the last link took it down with it
+	for _, t := range s.q.pending {
+		if !t.begun || t.settled {
+			continue
+		}
+		failure := ERR_UNACKNOWLEDGED
+		if t == s.lost {
+			failure = s.lost_err
+		}
+		r.Failed = append(r.Failed, Failure{t.name, failure})
+		d.FileError(t.name, failure)
+	}
+
+	//children come after their parents, anything still holding files stays
+	for i := len(s.q.folders) - 1; i >= 0; i-- {
+		if s.emptied[s.q.folders[i]] {
+			os.Remove(s.q.folders[i])
+		}
+	}
+
+	if s.started {
+		r.Elapsed = float64(Now()-s.start) / 1000000.0
+	}
+	switch {
+	case s.aborted != nil:
+		r.Err = s.aborted
+	case ctx.Err() != nil:
+		r.Err = ERR_INTERRUPTED
+	case !s.started && err != nil:
+		r.Err = err
+	case len(s.q.skipped) != 0 || len(r.Failed) != 0:
+		r.Err = fmt.Errorf("%d skipped, %d failed", len(s.q.skipped), len(r.Failed))
+	default:
+		r.Err = err
+	}
+	d.SessionDone(*r)
+
+	return r.Err
+}
@@ -0,0 +1,371 @@
+//sending and receiving sessions of files between peers
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"wire/protocol"
+)
+
+var DATA_PORT = 42069
+
+var CHUNK_SIZE int = 1024 * 1024
+
+type transfer struct {
+	name   string
+	path   string
+	number int
+
+	kind     byte
+	size     int64
+	progress int64
+
+	start int64
+	data  chan []byte
+
+	//shared with every other transfer under the same limit
+	limit *Limiter
+
+	//what was read while sending, checked against the receivers
+	sum []byte
+
+	//where this attempt picks up, whats before it arrived over an earlier link
+	resumed int64
+
+	//sending across reconnects, whether the header has gone out before and whether its finished with
+	begun   bool
+	settled bool
+}
+
+func (t transfer) header() protocol.Header {
+	return protocol.Header{Kind: t.kind, Size: t.size, Name: t.name}
+}
+
+func (t transfer) file() File {
+	return File{Name: t.name, Number: t.number, Size: t.size, Progress: t.progress, Resumed: t.resumed, Start: t.start}
+}
+
+func from_wire(reader io.Reader) (transfer, error) {
+	var t transfer
+	t.data = make(chan []byte, 10)
+
+	//a refused header still says what it was, so it can be answered and skipped
+	h, err := protocol.ReadHeader(reader)
+
+	t.kind = h.Kind
+	t.size = h.Size
+	t.name = h.Name
+	t.path = t.name
+
+	return t, err
+}
+
+func from_file(path, name string) (transfer, error) {
+	var t transfer
+
+	t.data = make(chan []byte, 10)
+	t.name = filepath.ToSlash(name)
+	t.path = path
+
+	//the peer would refuse it halfway through the session
+	if len(t.name) > protocol.MAX_NAME_LENGTH {
+		return t, fmt.Errorf("name too long")
+	}
+
+	i, err := os.Stat(t.path)
+	if err != nil {
+		return t, err
+	}
+	t.size = i.Size()
+
+	return t, nil
+}
+
+//files are written under this name until theyre complete
+var PARTIAL_SUFFIX = ".wire-part"
+
+func partial_size(path string) int64 {
+	i, err := os.Stat(path + PARTIAL_SUFFIX)
+	if err != nil || !i.Mode().IsRegular() {
+		return 0
+	}
+	return i.Size()
+}
+
+func resumable(ctx context.Context, err error) bool {
+	//only a dropped link is worth keeping the partial file for, anything else was on purpose
+	var aborted *AbortError
+	var cancelled *CancelError
+	var local *local_error
+	var refused *protocol.HeaderError
+	return ctx.Err() == nil && err != ERR_INTERRUPTED && !errors.As(err, &aborted) && !errors.As(err, &cancelled) && !errors.As(err, &local) && !errors.As(err, &refused)
+}
+
+func to_disk(ctx context.Context, reader io.Reader, t transfer, durable bool, display func(transfer)) (sum []byte, err error) {
+	partial := t.path + PARTIAL_SUFFIX
+
+	var file *os.File
+	file, err = open_file_for_writing(partial, t.resumed)
+	if err != nil {
+		return nil, &local_error{err}
+	}
+
+	//the sender checks this against what it read, including what arrived before a reconnect
+	hash := sha256.New()
+	if _, err = io.CopyN(hash, file, t.resumed); err != nil {
+		file.Close()
+		os.Remove(partial)
+		return nil, &local_error{err}
+	}
+	writer := bufio.NewWriter(local_file{file})
+	err = do_read_write(ctx, reader, io.MultiWriter(writer, hash), t, display)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil && durable {
+		if err = file.Sync(); err != nil {
+			err = &local_error{err}
+		}
+	}
+	if close_err := file.Close(); err == nil && close_err != nil {
+		err = &local_error{close_err}
+	}
+	//only now does it look complete
+	if err == nil {
+		if err = os.Rename(partial, t.path); err != nil {
+			err = &local_error{err}
+		}
+	}
+	if err == nil && durable {
+		if err = sync_dir(filepath.Dir(t.path)); err != nil {
+			err = &local_error{err}
+		}
+	}
+
+	if err != nil {
+		//a dropped link keeps what arrived so the sender can carry on from there
+		if !resumable(ctx, err) {
+			os.Remove(partial)
+		}
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func to_wire(ctx context.Context, writer io.Writer, file *os.File, t transfer, display func(transfer)) (sum []byte, err error) {
+	//the header has already gone, the receiver checks the whole file so hash whats being skipped
+	hash := sha256.New()
+	if _, err = io.CopyN(hash, local_file{file}, t.resumed); err != nil {
+		return nil, err
+	}
+	reader := io.TeeReader(bufio.NewReader(local_file{file}), hash)
+	if err = do_read_write(ctx, reader, frame_writer{writer}, t, display); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func do_read_write(ctx context.Context, reader io.Reader, writer io.Writer, t transfer, display func(transfer)) error {
+	read_progress := make(chan int, 1)
+	write_progress := make(chan int, 1)
+	errors := make(chan error, 2)
+
+	//both ends stop with us, the writer is always left between chunks
+	var running sync.WaitGroup
+	defer running.Wait()
+	stop, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if t.limit != nil {
+		reader = limited_reader{stop, reader, t.limit}
+	}
+
+	running.Add(2)
+	go func() {
+		read_into_channel(stop, reader, t.size-t.progress, t.data, read_progress, errors)
+		running.Done()
+	}()
+	go func() {
+		write_from_channel(stop, writer, t.size-t.progress, t.data, write_progress, errors)
+		running.Done()
+	}()
+
+	t.start = Now()
+	display(t)
+
+	done := 0
+	for done != 2 {
+		select {
+		case m := <-read_progress:
+			if m == -1 {
+				err := <-errors
+				return err
+			}
+			if m == 0 {
+				done++
+			}
+		case m := <-write_progress:
+			if m == -1 {
+				err := <-errors
+				return err
+			}
+			if m == 0 {
+				done++
+			}
+			if m > 0 {
+				t.progress += int64(m)
+				display(t)
+			}
+		case <-ctx.Done():
+			return ERR_INTERRUPTED
+		}
+	}
+
+	return nil
+}
+
+func min(a int, b int64) int {
+	if int64(a) <= b {
+		return a
+	} else {
+		return int(b)
+	}
+}
+
+//the other end may have given up, dont wait on it forever
+func report(ctx context.Context, progress chan int, n int) bool {
+	select {
+	case progress <- n:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func fail(ctx context.Context, err error, progress chan int, errors chan error) {
+	errors <- err
+	report(ctx, progress, -1)
+}
+
+func read_into_channel(ctx context.Context, reader io.Reader, size int64, channel chan []byte, progress chan int, errors chan error) {
+	total := int64(0)
+	for {
+		n := min(CHUNK_SIZE, size-total)
+		buffer := make([]byte, n)
+		err := protocol.ReadBuffer(reader, buffer)
+
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("link terminated")
+			}
+			fail(ctx, err, progress, errors)
+			//tell the writer to stop
+			select {
+			case channel <- nil:
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		total += int64(n)
+		select {
+		case channel <- buffer:
+		case <-ctx.Done():
+			return
+		}
+
+		//zero would read as done, empty files only report that
+		if n != 0 && !report(ctx, progress, n) {
+			return
+		}
+
+		if total == size {
+			report(ctx, progress, 0)
+			return
+		}
+	}
+}
+
+func write_from_channel(ctx context.Context, writer io.Writer, size int64, channel chan []byte, progress chan int, errors chan error) {
+	total := int64(0)
+	for {
+		var chunk []byte
+		select {
+		case chunk = <-channel:
+		case <-ctx.Done():
+			return
+		}
+
+		if chunk == nil {
+			//the reader failed and has already said why
+			return
+		}
+
+		err := protocol.WriteBuffer(writer, chunk)
+		if err != nil {
+			fail(ctx, err, progress, errors)
+			return
+		}
+		if len(chunk) != 0 && !report(ctx, progress, len(chunk)) {
+			return
+		}
+
+		total += int64(len(chunk))
+		if total == size {
+			report(ctx, progress, 0)
+			return
+		}
+
+		if total > size {
+			fail(ctx, fmt.Errorf("channel misaligned"), progress, errors)
+			return
+		}
+	}
+}
+
+func open_file_for_writing(path string, offset int64) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	if offset == 0 {
+		return os.Create(path)
+	}
+
+	//carrying on, keep whats there up to the offset and read it back from the start
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func open_file_for_reading(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+func expand_path(path string) []string {
+	//expand wildcards in the arguments etc
+	out := make([]string, 0)
+
+	matches, err := filepath.Glob(path)
+	if err != nil || len(matches) == 0 {
+		out = append(out, path)
+	} else {
+		out = append(out, matches...)
+	}
+
+	return out
+}
@@ -0,0 +1,341 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"wire/protocol"
+)
+
+func with_chunk_size(t *testing.T, size int) {
+	previous := CHUNK_SIZE
+	CHUNK_SIZE = size
+	t.Cleanup(func() { CHUNK_SIZE = previous })
+}
+
+//one byte per write, like a congested socket
+type short_writer struct {
+	bytes.Buffer
+}
+
+func (w *short_writer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return w.Buffer.Write(p[:1])
+}
+
+//runs both ends of the pipeline like do_read_write and checks what they report
+func pipeline(t *testing.T, reader io.Reader, writer io.Writer, size int64) error {
+	data := make(chan []byte, 10)
+	read_progress := make(chan int, 1)
+	write_progress := make(chan int, 1)
+	errors := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go read_into_channel(ctx, reader, size, data, read_progress, errors)
+	go write_from_channel(ctx, writer, size, data, write_progress, errors)
+
+	read_total, write_total := int64(0), int64(0)
+	done := 0
+	for done != 2 {
+		select {
+		case m := <-read_progress:
+			switch {
+			case m == -1:
+				return <-errors
+			case m == 0:
+				done++
+			default:
+				read_total += int64(m)
+			}
+		case m := <-write_progress:
+			switch {
+			case m == -1:
+				return <-errors
+			case m == 0:
+				done++
+			default:
+				write_total += int64(m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("pipeline stalled")
+		}
+	}
+
+	if read_total != size || write_total != size {
+		t.Errorf("read %d and wrote %d, want %d", read_total, write_total, size)
+	}
+
+	//nothing may be left over, it would block the goroutine forever
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case m := <-read_progress:
+		t.Errorf("extra read progress %d", m)
+	case m := <-write_progress:
+		t.Errorf("extra write progress %d", m)
+	default:
+	}
+
+	return nil
+}
+
+func TestPipeline(t *testing.T) {
+	with_chunk_size(t, 16)
+
+	sizes := []int{0, 1, 15, 16, 17, 32, 48, 1000}
+	readers := map[string]func(io.Reader) io.Reader{
+		"plain":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		"data err": iotest.DataErrReader,
+	}
+
+	for _, size := range sizes {
+		for name, wrap := range readers {
+			input := bytes.Repeat([]byte{7}, size)
+			input = append(input, []byte("trailing")...)
+
+			var output bytes.Buffer
+			if err := pipeline(t, wrap(bytes.NewReader(input)), &output, int64(size)); err != nil {
+				t.Errorf("%d bytes, %s reader: %v", size, name, err)
+				continue
+			}
+			if !bytes.Equal(output.Bytes(), input[:size]) {
+				t.Errorf("%d bytes, %s reader: output differs", size, name)
+			}
+		}
+	}
+}
+
+func TestPipelineShortWrites(t *testing.T) {
+	with_chunk_size(t, 16)
+
+	input := bytes.Repeat([]byte("abc"), 20)
+	var output short_writer
+	if err := pipeline(t, bytes.NewReader(input), &output, int64(len(input))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output.Bytes(), input) {
+		t.Fatal("output differs")
+	}
+}
+
+func TestPipelineTruncated(t *testing.T) {
+	with_chunk_size(t, 16)
+
+	for _, size := range []int{1, 16, 40} {
+		input := bytes.Repeat([]byte{1}, size-1)
+		var output bytes.Buffer
+		if err := pipeline(t, bytes.NewReader(input), &output, int64(size)); err == nil {
+			t.Errorf("%d bytes from %d: no error", size, size-1)
+		}
+	}
+}
+
+func TestDoReadWriteProgress(t *testing.T) {
+	with_chunk_size(t, 16)
+
+	for _, size := range []int64{0, 16, 40} {
+		input := bytes.Repeat([]byte{3}, int(size))
+		var output bytes.Buffer
+		var seen []File
+
+		tr := transfer{name: "f", size: size, data: make(chan []byte, 10)}
+		if err := do_read_write(context.Background(), bytes.NewReader(input), &output, tr, func(t transfer) { seen = append(seen, t.file()) }); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(seen) == 0 || seen[0].Progress != 0 {
+			t.Fatalf("%d bytes: start not reported", size)
+		}
+		if last := seen[len(seen)-1]; last.Progress != size {
+			t.Fatalf("%d bytes: finished at %d", size, last.Progress)
+		}
+		if size == 0 && len(seen) != 1 {
+			t.Fatalf("empty file reported %d times", len(seen))
+		}
+	}
+}
+
+func TestFromWire(t *testing.T) {
+	sent := transfer{kind: protocol.KIND_FILE, name: "dir/file name.txt", size: 1 << 40}
+
+	var buffer bytes.Buffer
+	buffer.Write(sent.header().Build())
+	buffer.WriteString("payload")
+
+	got, err := from_wire(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.kind != sent.kind || got.size != sent.size || got.name != filepath.FromSlash(sent.name) {
+		t.Fatalf("got %+v", got.header())
+	}
+	if got.path != got.name {
+		t.Fatalf("path %q", got.path)
+	}
+	if buffer.String() != "payload" {
+		t.Fatal("header over read")
+	}
+}
+
+func TestFromFile(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "f")
+	os.WriteFile(path, []byte("12345"), 0600)
+
+	tr, err := from_file(path, filepath.Join("a", "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.size != 5 || tr.name != "a/f" || tr.path != path {
+		t.Fatalf("got %q %q %d", tr.name, tr.path, tr.size)
+	}
+
+	if _, err = from_file(filepath.Join(root, "missing"), "missing"); err == nil {
+		t.Fatal("missing file opened")
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.log"} {
+		os.WriteFile(filepath.Join(root, name), nil, 0600)
+	}
+
+	got := expand_path(filepath.Join(root, "*.txt"))
+	sort.Strings(got)
+	want := []string{filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt")}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("got %v", got)
+	}
+
+	//no match and bad patterns are passed through so the error names them
+	for _, path := range []string{filepath.Join(root, "*.md"), filepath.Join(root, "c.log"), "[", filepath.Join(root, "missing")} {
+		if got := expand_path(path); len(got) != 1 || got[0] != path {
+			t.Errorf("%q: got %v", path, got)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	root := t.TempDir()
+	write_tree(t, root, map[string][]byte{"a.txt": []byte("abc"), "d/b": []byte("hello"), "d/c.o": nil})
+
+	sender := Sender{Filter: &Filter{Exclude: []string{"*.o"}}}
+	plan := sender.Plan([]string{filepath.Join(root, "*.txt"), filepath.Join(root, "d"), filepath.Join(root, "*.md")})
+
+	if len(plan.Files) != 2 || plan.Files[0].Name != "a.txt" || plan.Files[1].Name != "d/b" || plan.Size != 8 {
+		t.Fatalf("got %+v", plan.Files)
+	}
+	if plan.Filtered != 1 {
+		t.Fatalf("%d filtered", plan.Filtered)
+	}
+	if len(plan.Skipped) != 1 || plan.Skipped[0].Err.Error() != "no files match" {
+		t.Fatalf("skipped %v", plan.Skipped)
+	}
+}
+
+func TestReadPaths(t *testing.T) {
+	got, err := ReadPaths(bytes.NewBufferString("a b\r\n\nc/d\n"), false)
+	if err != nil || len(got) != 2 || got[0] != "a b" || got[1] != "c/d" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	got, err = ReadPaths(bytes.NewBufferString("new\nline\x00x\x00"), true)
+	if err != nil || len(got) != 2 || got[0] != "new\nline" || got[1] != "x" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestPlanNaming(t *testing.T) {
+	root := t.TempDir()
+	write_tree(t, root, map[string][]byte{"a/x": nil, "a/sub/y": nil, "b/x": nil})
+	paths := []string{filepath.Join(root, "a"), filepath.Join(root, "b", "x")}
+
+	names := func(plan Plan) []string {
+		out := make([]string, 0)
+		for _, f := range plan.Files {
+			out = append(out, f.Name)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	plan := (&Sender{Base: root}).Plan(paths)
+	if got := names(plan); len(got) != 3 || got[0] != "a/sub/y" || got[1] != "a/x" || got[2] != "b/x" {
+		t.Fatalf("base: got %v", got)
+	}
+
+	//the second x clashes with the first
+	plan = (&Sender{Flatten: true}).Plan(paths)
+	if got := names(plan); len(got) != 2 || got[0] != "x" || got[1] != "y" || len(plan.Skipped) != 1 {
+		t.Fatalf("flatten: got %v, skipped %v", got, plan.Skipped)
+	}
+
+	plan = (&Sender{Base: filepath.Join(root, "a")}).Plan(paths)
+	if len(plan.Files) != 2 || len(plan.Skipped) != 1 {
+		t.Fatalf("outside base: got %v, skipped %v", names(plan), plan.Skipped)
+	}
+}
+
+func TestSplitDestination(t *testing.T) {
+	root := t.TempDir()
+	existing := filepath.Join(root, "12:30.wav")
+	if runtime.GOOS != "windows" {
+		os.WriteFile(existing, nil, 0600)
+	}
+
+	cases := []struct{ arg, source, destination string }{
+		{"a/b", "a/b", ""},
+		{"a/b:x/y", "a/b", "x/y"},
+		{"*.wav:audio", "*.wav", "audio"},
+		{":x", ":x", ""},
+	}
+	if runtime.GOOS != "windows" {
+		cases = append(cases, struct{ arg, source, destination string }{existing, existing, ""})
+	}
+	for _, c := range cases {
+		if source, destination := split_destination(c.arg); source != c.source || destination != c.destination {
+			t.Errorf("%q: got %q %q", c.arg, source, destination)
+		}
+	}
+}
+
+func TestPlanDestination(t *testing.T) {
+	root := t.TempDir()
+	write_tree(t, root, map[string][]byte{"build/out/app": nil, "build/out/lib/x.so": nil, "notes": nil})
+
+	sender := Sender{Prefix: "artifacts", Strip: 1}
+	plan := sender.Plan([]string{filepath.Join(root, "build"), filepath.Join(root, "notes") + ":docs/text", filepath.Join(root, "build") + ":../up"})
+
+	got := make([]string, 0)
+	for _, f := range plan.Files {
+		got = append(got, f.Name)
+	}
+	sort.Strings(got)
+	//notes has no folder to strip, the escaping destination is refused
+	want := []string{"artifacts/out/app", "artifacts/out/lib/x.so"}
+	if !reflect.DeepEqual(got, want) || len(plan.Skipped) != 2 {
+		t.Fatalf("got %v, skipped %v", got, plan.Skipped)
+	}
+
+	//a destination replaces the prefix
+	sender.Strip = 0
+	plan = sender.Plan([]string{filepath.Join(root, "notes") + ":docs/text"})
+	if len(plan.Files) != 1 || plan.Files[0].Name != "docs/text/notes" {
+		t.Fatalf("got %+v", plan.Files)
+	}
+}
@@ -0,0 +1,113 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+//how connections between peers are made, streams either way
+type Transport interface {
+	Dial(ctx context.Context, local, remote string) (net.Conn, error)
+	Listen(local string) (net.Listener, error)
+}
+
+func transport_or_tcp(t Transport) Transport {
+	if t == nil {
+		return TCP{}
+	}
+	return t
+}
+
+//the default, tcp over ipv6 on DATA_PORT
+type TCP struct{}
+
+func (TCP) Dial(ctx context.Context, local, remote string) (net.Conn, error) {
+	raddr := fmt.Sprintf("[%s]:%d", remote, DATA_PORT)
+	laddr, _ := net.ResolveTCPAddr("tcp6", fmt.Sprintf("[%s]:0", local))
+
+	dialer := net.Dialer{LocalAddr: laddr}
+	return dialer.DialContext(ctx, "tcp6", raddr)
+}
+
+func (TCP) Listen(local string) (net.Listener, error) {
+	addr, _ := net.ResolveTCPAddr("tcp6", fmt.Sprintf("[%s]:%d", local, DATA_PORT))
+	ln, err := net.ListenTCP("tcp6", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tcp_listener{ln}, nil
+}
+
+type tcp_listener struct {
+	*net.TCPListener
+}
+
+func (ln tcp_listener) Accept() (net.Conn, error) {
+	conn, err := ln.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	//notice a peer that vanished without closing
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(time.Second)
+	return conn, nil
+}
+
+//connects dialers to listeners in the same process, for tests and embedding
+type Pipe struct {
+	conns chan net.Conn
+}
+
+func NewPipe() *Pipe {
+	return &Pipe{conns: make(chan net.Conn)}
+}
+
+func (p *Pipe) Dial(ctx context.Context, local, remote string) (net.Conn, error) {
+	client, server := net.Pipe()
+
+	//blocks until a listener picks it up
+	select {
+	case p.conns <- server:
+		return client, nil
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Pipe) Listen(local string) (net.Listener, error) {
+	return &pipe_listener{conns: p.conns, done: make(chan bool)}, nil
+}
+
+type pipe_listener struct {
+	conns chan net.Conn
+	done  chan bool
+	once  sync.Once
+}
+
+func (ln *pipe_listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *pipe_listener) Close() error {
+	ln.once.Do(func() { close(ln.done) })
+	return nil
+}
+
+func (ln *pipe_listener) Addr() net.Addr {
+	return pipe_addr{}
+}
+
+type pipe_addr struct{}
+
+func (pipe_addr) Network() string { return "pipe" }
+func (pipe_addr) String() string  { return "pipe" }
@@ -0,0 +1,847 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"wire/protocol"
+)
+
+func write_tree(t *testing.T, root string, files map[string][]byte) {
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func check_tree(t *testing.T, root string, files map[string][]byte) {
+	for name, data := range files {
+		got, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: got %d bytes, want %d", name, len(got), len(data))
+		}
+	}
+}
+
+func TestPipeSendReceive(t *testing.T) {
+	source := t.TempDir()
+	destination := t.TempDir()
+
+	files := map[string][]byte{
+		"d/a":       []byte("hello"),
+		"d/empty":   {},
+		"d/sub/big": bytes.Repeat([]byte("wire"), CHUNK_SIZE/2+3),
+	}
+	write_tree(t, source, files)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	receiver := Receiver{Root: destination, AutoAccept: true, Once: true, Fsync: true, Transport: pipe}
+	served := make(chan error, 1)
+	go func() {
+		served <- receiver.Serve(ctx)
+	}()
+
+	sender := Sender{Transport: pipe}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "d")}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+
+	check_tree(t, destination, files)
+}
+
+func TestPipeBackslashName(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("backslashes cant be in a file name here")
+	}
+	source := t.TempDir()
+	destination := t.TempDir()
+	write_tree(t, source, map[string][]byte{`d/a\b`: []byte("data")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	receiver := Receiver{Root: destination, AutoAccept: true, Once: true, Transport: pipe}
+	served := make(chan error, 1)
+	go func() {
+		served <- receiver.Serve(ctx)
+	}()
+
+	//the receiver reads it as a folder, its ack has to be matched under that name
+	done := make(chan Summary, 1)
+	sender := Sender{Transport: pipe, Events: progress_events{done: done}}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "d")}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if r := <-done; r.Files != 1 {
+		t.Fatalf("sender counted %d files", r.Files)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	check_tree(t, destination, map[string][]byte{"d/a/b": []byte("data")})
+}
+
+func TestPipeRejected(t *testing.T) {
+	source := t.TempDir()
+	write_tree(t, source, map[string][]byte{"f": []byte("data")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	receiver := Receiver{Root: t.TempDir(), Prompt: func(s Session) bool { return false }, Transport: pipe}
+	go receiver.Serve(ctx)
+
+	sender := Sender{Transport: pipe}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "f")}); err == nil {
+		t.Fatal("declined session was sent")
+	}
+}
+
+func TestPipeTrustedName(t *testing.T) {
+	source := t.TempDir()
+	write_tree(t, source, map[string][]byte{"f": []byte("data")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	//anyone can claim a trusted name, a pipe has no address for it to resolve to
+	pipe := NewPipe()
+	asked := 0
+	receiver := Receiver{Root: t.TempDir(), Trusted: []string{protocol.Hostname()}, Transport: pipe}
+	receiver.Prompt = func(s Session) bool {
+		asked++
+		return false
+	}
+	go receiver.Serve(ctx)
+
+	sender := Sender{Transport: pipe}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "f")}); err == nil {
+		t.Fatal("session from a claimed name was accepted")
+	}
+	if asked != 1 {
+		t.Fatalf("asked %d times", asked)
+	}
+}
+
+func TestPipeLimitBeforePrompt(t *testing.T) {
+	source := t.TempDir()
+	write_tree(t, source, map[string][]byte{"d/a": []byte("a"), "d/b": []byte("b")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	asked := 0
+	receiver := Receiver{Root: t.TempDir(), MaxTotalFiles: 1, Transport: pipe}
+	receiver.Prompt = func(s Session) bool {
+		asked++
+		return true
+	}
+	go receiver.Serve(ctx)
+
+	sender := Sender{Transport: pipe}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "d")}); err == nil {
+		t.Fatal("session over the run limit was accepted")
+	}
+	if asked != 0 {
+		t.Fatal("asked about a session that was going to be rejected")
+	}
+}
+
+func TestPipeList(t *testing.T) {
+	root := t.TempDir()
+	write_tree(t, root, map[string][]byte{"shared/a": []byte("abc"), "shared/b/c": nil})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	receiver := Receiver{Root: root, Share: true, Transport: pipe}
+	go receiver.Serve(ctx)
+
+	entries, err := List(ctx, pipe, "", "", "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+
+	if _, err = List(ctx, pipe, "", "", "../"); err == nil {
+		t.Fatal("listing outside the root succeeded")
+	}
+
+	//not every system lets anyone make symlinks
+	outside := t.TempDir()
+	write_tree(t, outside, map[string][]byte{"sub/secret": []byte("x")})
+	if os.Symlink(outside, filepath.Join(root, "shared/link")) == nil {
+		if _, err = List(ctx, pipe, "", "", "shared/link/sub"); err == nil {
+			t.Fatal("listing through a symlink out of the root succeeded")
+		}
+	}
+}
+
+//calls back on every progress update
+type progress_events struct {
+	no_events
+	file     func(f File)
+	finished func(f File)
+	done     chan Summary
+}
+
+func (e progress_events) File(f File) {
+	if e.file != nil {
+		e.file(f)
+	}
+}
+
+func (e progress_events) FileDone(f File) {
+	if e.finished != nil {
+		e.finished(f)
+	}
+}
+
+func (e progress_events) SessionDone(r Summary) {
+	if e.done != nil {
+		e.done <- r
+	}
+}
+
+func TestPipeSenderInterrupted(t *testing.T) {
+	with_chunk_size(t, 1024)
+
+	source := t.TempDir()
+	destination := t.TempDir()
+	write_tree(t, source, map[string][]byte{"big": bytes.Repeat([]byte{1}, 1024*1024)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	done := make(chan Summary, 1)
+	receiver := Receiver{Root: destination, AutoAccept: true, Once: true, Transport: pipe}
+	receiver.Events = func() Events { return progress_events{done: done} }
+	go receiver.Serve(ctx)
+
+	interrupt, stop := context.WithCancel(ctx)
+	sender := Sender{Transport: pipe}
+	sender.Events = progress_events{file: func(f File) {
+		if f.Progress > 0 {
+			stop()
+		}
+	}}
+
+	if err := sender.Send(interrupt, "", []string{filepath.Join(source, "big")}); err != ERR_INTERRUPTED {
+		t.Fatalf("send: %v", err)
+	}
+
+	r := <-done
+	if _, ok := r.Err.(*AbortError); !ok {
+		t.Fatalf("receive: %v", r.Err)
+	}
+	if _, err := os.Stat(filepath.Join(destination, "big")); !os.IsNotExist(err) {
+		t.Fatal("partial file left behind")
+	}
+}
+
+func TestPipeReceiverInterrupted(t *testing.T) {
+	with_chunk_size(t, 1024)
+
+	source := t.TempDir()
+	destination := t.TempDir()
+	write_tree(t, source, map[string][]byte{"big": bytes.Repeat([]byte{1}, 1024*1024)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	interrupt, stop := context.WithCancel(ctx)
+	pipe := NewPipe()
+	receiver := Receiver{Root: destination, AutoAccept: true, Transport: pipe}
+	receiver.Events = func() Events {
+		return progress_events{file: func(f File) {
+			if f.Progress > 0 {
+				stop()
+			}
+		}}
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- receiver.Serve(interrupt)
+	}()
+
+	sender := Sender{Transport: pipe}
+	err := sender.Send(ctx, "", []string{filepath.Join(source, "big")})
+	if e, ok := err.(*AbortError); !ok || e.Reason != "receiver interrupted" {
+		t.Fatalf("send: %v", err)
+	}
+
+	if err := <-served; err != ERR_INTERRUPTED {
+		t.Fatalf("receive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destination, "big")); !os.IsNotExist(err) {
+		t.Fatal("partial file left behind")
+	}
+}
+
+func TestPipeReceiverFileFailed(t *testing.T) {
+	source := t.TempDir()
+	destination := t.TempDir()
+	files := map[string][]byte{"d/a": []byte("hello"), "d/b": bytes.Repeat([]byte{2}, 4096), "d/c": []byte("world")}
+	write_tree(t, source, files)
+
+	//a folder where a file should go can only fail that one file
+	if err := os.MkdirAll(filepath.Join(destination, "d", "b"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	receiver := Receiver{Root: destination, AutoAccept: true, Once: true, Transport: pipe}
+	served := make(chan error, 1)
+	go func() {
+		served <- receiver.Serve(ctx)
+	}()
+
+	//every byte of it went out, its only done once the receiver says so
+	done := make(chan Summary, 1)
+	finished := make([]string, 0)
+	sender := Sender{Transport: pipe, Events: progress_events{done: done, finished: func(f File) { finished = append(finished, f.Name) }}}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "d")}); err == nil {
+		t.Fatal("send succeeded")
+	}
+	r := <-done
+	if r.Files != 2 || len(r.Failed) != 1 || r.Failed[0].Name != "d/b" {
+		t.Fatalf("sender saw %d files and failures %v", r.Files, r.Failed)
+	}
+	if len(finished) != 2 || finished[0] != "d/a" || finished[1] != "d/c" {
+		t.Fatalf("sender finished %v", finished)
+	}
+
+	if err := <-served; err == nil {
+		t.Fatal("receive succeeded")
+	}
+	delete(files, "d/b")
+	check_tree(t, destination, files)
+}
+
+func TestPipeSenderFileCancelled(t *testing.T) {
+	with_chunk_size(t, 1024)
+
+	source := t.TempDir()
+	destination := t.TempDir()
+	files := map[string][]byte{"d/a": []byte("hello"), "d/b": bytes.Repeat([]byte{2}, 1024*1024), "d/c": []byte("world")}
+	write_tree(t, source, files)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	done := make(chan Summary, 1)
+	receiver := Receiver{Root: destination, AutoAccept: true, Once: true, Transport: pipe}
+	receiver.Events = func() Events { return progress_events{done: done} }
+	go receiver.Serve(ctx)
+
+	//the source shrinking partway through loses that file and nothing else
+	sender := Sender{Transport: pipe, KeepGoing: true}
+	sender.Events = progress_events{file: func(f File) {
+		if f.Name == "d/b" && f.Progress > 0 {
+			os.Truncate(filepath.Join(source, "d", "b"), 0)
+		}
+	}}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "d")}); err == nil {
+		t.Fatal("send succeeded")
+	}
+
+	r := <-done
+	if r.Files != 2 || len(r.Skipped) != 1 {
+		t.Fatalf("receiver saw %d files and skipped %v", r.Files, r.Skipped)
+	}
+	if _, ok := r.Skipped[0].Err.(*CancelError); !ok {
+		t.Fatalf("skipped for %v", r.Skipped[0].Err)
+	}
+	delete(files, "d/b")
+	check_tree(t, destination, files)
+	if _, err := os.Stat(filepath.Join(destination, "d", "b")); !os.IsNotExist(err) {
+		t.Fatal("partial file left behind")
+	}
+}
+
+func TestPipeUnacknowledged(t *testing.T) {
+	source := t.TempDir()
+	write_tree(t, source, map[string][]byte{"d/a": []byte("hello"), "d/b": []byte("world")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	//takes everything and hangs up without saying it landed
+	pipe := NewPipe()
+	ln, _ := pipe.Listen("")
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		h, _ := protocol.ReadHeader(conn)
+		protocol.ReadPayload(conn, h)
+		protocol.WriteMessage(conn, protocol.KIND_ACCEPT, "silent", nil)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+
+	done := make(chan Summary, 1)
+	finished := 0
+	sender := Sender{Transport: pipe, Events: progress_events{done: done, finished: func(f File) { finished++ }}}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "d")}); err == nil {
+		t.Fatal("send succeeded")
+	}
+	r := <-done
+	if r.Files != 0 || len(r.Failed) != 2 || r.Failed[0].Err != ERR_UNACKNOWLEDGED {
+		t.Fatalf("sender saw %d files and failures %v", r.Files, r.Failed)
+	}
+	if finished != 0 {
+		t.Fatalf("%d unacknowledged files reported done", finished)
+	}
+}
+
+func TestPipeMove(t *testing.T) {
+	source := t.TempDir()
+	destination := t.TempDir()
+	files := map[string][]byte{"d/a": []byte("hello"), "d/sub/b": []byte("world"), "d/sub/deeper/c": {}}
+	write_tree(t, source, files)
+	//folders that were empty to begin with arent ours to remove
+	if err := os.MkdirAll(filepath.Join(source, "d", "keep"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	receiver := Receiver{Root: destination, AutoAccept: true, Once: true, Transport: pipe}
+	receiver.Prompt = func(s Session) bool { return s.Durable }
+	go receiver.Serve(ctx)
+
+	sender := Sender{Transport: pipe, Move: true}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "d")}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	check_tree(t, destination, files)
+	for _, gone := range []string{"d/a", "d/sub"} {
+		if _, err := os.Stat(filepath.Join(source, gone)); !os.IsNotExist(err) {
+			t.Errorf("%s still there", gone)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(source, "d", "keep")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPipeMoveTrailingSlash(t *testing.T) {
+	source := t.TempDir()
+	destination := t.TempDir()
+	write_tree(t, source, map[string][]byte{"card/DCIM/a": []byte("hello"), "card/DCIM/sub/b": []byte("world")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	receiver := Receiver{Root: destination, AutoAccept: true, Once: true, Transport: pipe}
+	go receiver.Serve(ctx)
+
+	//the folder itself goes too, not just whats under it
+	sender := Sender{Transport: pipe, Move: true}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "card", "DCIM") + string(filepath.Separator)}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	check_tree(t, destination, map[string][]byte{"a": []byte("hello"), "sub/b": []byte("world")})
+	if _, err := os.Stat(filepath.Join(source, "card", "DCIM")); !os.IsNotExist(err) {
+		t.Error("emptied folder still there")
+	}
+	if _, err := os.Stat(filepath.Join(source, "card")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPipeMoveMismatch(t *testing.T) {
+	source := t.TempDir()
+	write_tree(t, source, map[string][]byte{"f": []byte("hello")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	//acknowledges everything with the wrong checksum
+	pipe := NewPipe()
+	ln, _ := pipe.Listen("")
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		h, _ := protocol.ReadHeader(conn)
+		protocol.ReadPayload(conn, h)
+		protocol.WriteMessage(conn, protocol.KIND_ACCEPT, "liar", nil)
+		for {
+			h, err := protocol.ReadHeader(conn)
+			if err != nil {
+				return
+			}
+			io.CopyN(io.Discard, &frame_reader{ctx: ctx, reader: conn}, h.Size)
+			protocol.WriteMessage(conn, protocol.KIND_ACK, h.Name, make([]byte, 32))
+		}
+	}()
+
+	done := make(chan Summary, 1)
+	sender := Sender{Transport: pipe, Move: true, Events: progress_events{done: done}}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "f")}); err == nil {
+		t.Fatal("send succeeded")
+	}
+	r := <-done
+	if r.Files != 0 || len(r.Failed) != 1 || r.Failed[0].Err != ERR_MISMATCH {
+		t.Fatalf("sender saw %d files and failures %v", r.Files, r.Failed)
+	}
+	if _, err := os.Stat(filepath.Join(source, "f")); err != nil {
+		t.Fatal("source removed after a bad checksum")
+	}
+}
+
+//the first link hangs up after that many bytes, every link after it is fine
+type dropping_transport struct {
+	*Pipe
+	after   int64
+	dropped bool
+}
+
+func (d *dropping_transport) Dial(ctx context.Context, local, remote string) (net.Conn, error) {
+	conn, err := d.Pipe.Dial(ctx, local, remote)
+	if err != nil || d.dropped {
+		return conn, err
+	}
+	d.dropped = true
+	return &dropping_conn{Conn: conn, left: d.after}, nil
+}
+
+type dropping_conn struct {
+	net.Conn
+	left int64
+}
+
+func (c *dropping_conn) Write(p []byte) (int, error) {
+	if int64(len(p)) > c.left {
+		n, _ := c.Conn.Write(p[:c.left])
+		c.Conn.Close()
+		return n, fmt.Errorf("link dropped")
+	}
+	c.left -= int64(len(p))
+	return c.Conn.Write(p)
+}
+
+type reconnect_events struct {
+	progress_events
+	reconnects chan error
+}
+
+func (e reconnect_events) Reconnecting(attempt, retries int, delay time.Duration, err error) {
+	e.reconnects <- err
+}
+
+func TestPipeReconnect(t *testing.T) {
+	with_chunk_size(t, 1024)
+
+	source := t.TempDir()
+	destination := t.TempDir()
+	files := map[string][]byte{"d/a": []byte("hello"), "d/b": random_bytes(256 * 1024), "d/c": []byte("world")}
+	write_tree(t, source, files)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	//the second link is the same session, it isnt asked about again
+	pipe := NewPipe()
+	asked := 0
+	//once is the session, not the first link it came over
+	receiver := Receiver{Root: destination, Once: true, Transport: pipe}
+	receiver.Prompt = func(s Session) bool {
+		asked++
+		return true
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- receiver.Serve(ctx)
+	}()
+
+	var resumed int64
+	done := make(chan Summary, 1)
+	events := reconnect_events{reconnects: make(chan error, 8)}
+	events.done = done
+	events.file = func(f File) {
+		if f.Resumed > resumed {
+			resumed = f.Resumed
+		}
+	}
+	sender := Sender{Transport: &dropping_transport{Pipe: pipe, after: 100 * 1024}, Retries: 2, Backoff: 10 * time.Millisecond, Events: events}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "d")}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	r := <-done
+	if r.Files != 3 || len(r.Failed) != 0 {
+		t.Fatalf("sender saw %d files and failures %v", r.Files, r.Failed)
+	}
+	if len(events.reconnects) != 1 || asked != 1 {
+		t.Fatalf("%d reconnects and %d prompts", len(events.reconnects), asked)
+	}
+	if resumed == 0 {
+		t.Fatal("started over instead of resuming")
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	check_tree(t, destination, files)
+	if _, err := os.Stat(filepath.Join(destination, "d", "b"+PARTIAL_SUFFIX)); !os.IsNotExist(err) {
+		t.Fatal("partial file left behind")
+	}
+}
+
+func TestPipeDroppedPartial(t *testing.T) {
+	with_chunk_size(t, 1024)
+
+	source := t.TempDir()
+	destination := t.TempDir()
+	write_tree(t, source, map[string][]byte{"big": random_bytes(256 * 1024)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	interrupt, stop := context.WithCancel(ctx)
+	pipe := NewPipe()
+	done := make(chan Summary, 1)
+	receiver := Receiver{Root: destination, AutoAccept: true, Transport: pipe}
+	receiver.Events = func() Events {
+		return progress_events{done: done}
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- receiver.Serve(interrupt)
+	}()
+
+	//the sender gives up straight away, the part is kept in case it comes back anyway
+	sender := Sender{Transport: &dropping_transport{Pipe: pipe, after: 100 * 1024}}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "big")}); err == nil {
+		t.Fatal("send over a dropped link succeeded")
+	}
+	<-done
+	partial := filepath.Join(destination, "big"+PARTIAL_SUFFIX)
+	if _, err := os.Stat(partial); err != nil {
+		t.Fatalf("part not kept: %v", err)
+	}
+
+	stop()
+	if err := <-served; err != ERR_INTERRUPTED {
+		t.Fatalf("receive: %v", err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Fatal("partial file left behind")
+	}
+}
+
+func TestPipeOnceDropped(t *testing.T) {
+	with_chunk_size(t, 1024)
+
+	source := t.TempDir()
+	destination := t.TempDir()
+	write_tree(t, source, map[string][]byte{"big": random_bytes(256 * 1024)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	receiver := Receiver{Root: destination, AutoAccept: true, Once: true, ResumeWait: 50 * time.Millisecond, Transport: pipe}
+	served := make(chan error, 1)
+	go func() {
+		served <- receiver.Serve(ctx)
+	}()
+
+	//the sender never comes back, once gives up on it rather than waiting out the resume window
+	sender := Sender{Transport: &dropping_transport{Pipe: pipe, after: 100 * 1024}}
+	if err := sender.Send(ctx, "", []string{filepath.Join(source, "big")}); err == nil {
+		t.Fatal("send over a dropped link succeeded")
+	}
+	if err := <-served; err == nil || ctx.Err() != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destination, "big"+PARTIAL_SUFFIX)); !os.IsNotExist(err) {
+		t.Fatal("partial file left behind")
+	}
+}
+
+func TestPipeRefusedName(t *testing.T) {
+	destination := t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pipe := NewPipe()
+	receiver := Receiver{Root: destination, AutoAccept: true, Once: true, Transport: pipe}
+	served := make(chan error, 1)
+	go func() {
+		served <- receiver.Serve(ctx)
+	}()
+
+	//a name only another system would send, the sender cant be trusted to have caught it
+	conn, err := pipe.Dial(ctx, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	if _, err = start_session(reader, writer, protocol.Session{Name: "peer", Files: 2, Size: 6}); err != nil {
+		t.Fatal(err)
+	}
+
+	//the answers come back while the data is still going out
+	answers := make(chan protocol.Header, 2)
+	go func() {
+		for {
+			h, err := protocol.ReadHeader(reader)
+			if err != nil {
+				close(answers)
+				return
+			}
+			protocol.ReadPayload(reader, h)
+			answers <- h
+		}
+	}()
+
+	for _, f := range []struct{ name, data string }{{`..\x`, "data"}, {"ok", "ok"}} {
+		header := protocol.Header{Kind: protocol.KIND_FILE, Size: int64(len(f.data)), Name: f.name}
+		protocol.WriteBuffer(writer, header.Build())
+		frame_writer{writer}.Write([]byte(f.data))
+		if err = writer.Flush(); err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+	}
+
+	if h := <-answers; h.Kind != protocol.KIND_FAILED || h.Name != `..\x` {
+		t.Fatalf("refused name answered with %d %q", h.Kind, h.Name)
+	}
+	if h := <-answers; h.Kind != protocol.KIND_ACK || h.Name != "ok" {
+		t.Fatalf("next file answered with %d %q", h.Kind, h.Name)
+	}
+	conn.Close()
+
+	//only the one file was lost, theres nothing to wait for a reconnect over
+	if err := <-served; err == nil || ctx.Err() != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	check_tree(t, destination, map[string][]byte{"ok": []byte("ok")})
+	if _, err := os.Stat(filepath.Join(filepath.Dir(destination), "x")); !os.IsNotExist(err) {
+		t.Fatal("file written outside the root")
+	}
+}
+
+type refusing_transport struct {
+	*Pipe
+}
+
+func (refusing_transport) Dial(ctx context.Context, local, remote string) (net.Conn, error) {
+	return nil, fmt.Errorf("refused")
+}
+
+func TestPipeDialFailed(t *testing.T) {
+	source := t.TempDir()
+	write_tree(t, source, map[string][]byte{"f": []byte("data")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	//the summary is the only place the reason shows up
+	done := make(chan Summary, 1)
+	sender := Sender{Transport: refusing_transport{NewPipe()}, Events: progress_events{done: done}}
+	err := sender.Send(ctx, "", []string{filepath.Join(source, "f")})
+	if err == nil {
+		t.Fatal("send to nobody succeeded")
+	}
+	select {
+	case r := <-done:
+		if r.Err != err {
+			t.Fatalf("summary says %v, send returned %v", r.Err, err)
+		}
+	default:
+		t.Fatal("no summary for a send that never connected")
+	}
+}
+
+func TestReceiverArrived(t *testing.T) {
+	var rcv Receiver
+	token := [16]byte{1}
+
+	//the second link of a session sends a file whose ack was lost again
+	rcv.remember(token, "peer")
+	if rcv.arrived(token, "a") {
+		t.Fatal("first arrival counted as a repeat")
+	}
+	rcv.remember(token, "peer")
+	if !rcv.arrived(token, "a") || rcv.arrived(token, "b") {
+		t.Fatal("repeats not told apart across links")
+	}
+	if rcv.arrived([16]byte{}, "a") || rcv.arrived([16]byte{}, "a") {
+		t.Fatal("a session without a token has no earlier links")
+	}
+}
+
+func TestReceiverPartialExpires(t *testing.T) {
+	previous := RESUME_WINDOW
+	RESUME_WINDOW = 10 * time.Millisecond
+	t.Cleanup(func() { RESUME_WINDOW = previous })
+
+	var rcv Receiver
+	token := [16]byte{1}
+	path := filepath.Join(t.TempDir(), "f")
+	write_tree(t, filepath.Dir(path), map[string][]byte{"f" + PARTIAL_SUFFIX: []byte("half")})
+
+	//the sender never comes back for it
+	rcv.remember(token, "peer")
+	rcv.keep_partial(token, path)
+	for wait := time.Now(); time.Since(wait) < time.Second; time.Sleep(time.Millisecond) {
+		if _, err := os.Stat(path + PARTIAL_SUFFIX); os.IsNotExist(err) {
+			if rcv.is_reconnect(token, "peer") {
+				t.Fatal("expired session still recognised")
+			}
+			return
+		}
+	}
+	t.Fatal("part outlived the resume window")
+}
@@ -0,0 +1,38 @@
+//go:build windows
+// +build windows
+
+package transfer
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+func Now() int64 {
+	var t windows.Filetime
+	windows.GetSystemTimePreciseAsFileTime(&t)
+	return t.Nanoseconds()
+}
+
+func free_space(path string) (uint64, error) {
+	directory, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var available, total, free uint64
+	if err = windows.GetDiskFreeSpaceEx(directory, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
+
+func is_disk_full(err error) bool {
+	return errors.Is(err, windows.ERROR_DISK_FULL) || errors.Is(err, windows.ERROR_HANDLE_DISK_FULL)
+}
+
+func sync_dir(path string) error {
+	//directories cant be flushed here, ntfs journals the entry anyway
+	return nil
+}
@@ -1,183 +1,34 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 )
 
-var CHUNK_SIZE int = 1024 * 1024
+//turned off for NO_COLOR and anything that isnt a terminal
+var colors = true
 
-func min(a int, b int64) int {
-	if int64(a) <= b {
-		return a
-	} else {
-		return int(b)
-	}
-}
-
-func read_into_buffer(reader io.Reader, buffer []byte) error {
-	total := 0
-	len := len(buffer)
-	for total != len {
-		n, err := reader.Read(buffer[total:])
-		if err != nil {
-			return err
-		}
-		total += n
-	}
-	return nil
-}
-
-func write_from_buffer(writer io.Writer, buffer []byte) error {
-	total := 0
-	len := len(buffer)
-	for total != len {
-		n, err := writer.Write(buffer[total:])
-		if err != nil {
-			return err
-		}
-		total += n
-	}
-	return nil
-}
-
-func read_into_channel(reader io.Reader, size int64, channel chan []byte, progress chan int, errors chan error) {
-	total := int64(0)
-	for {
-		n := min(CHUNK_SIZE, size-total)
-		buffer := make([]byte, n)
-		err := read_into_buffer(reader, buffer)
-
-		if err != nil {
-			progress <- -1
-			channel <- nil
-			errors <- fmt.Errorf("link terminated")
-			return
-		}
-
-		total += int64(n)
-		channel <- buffer
-		progress <- n
-
-		if total == size {
-			progress <- 0
-			return
-		}
-
-		if total > size {
-			progress <- -1
-			channel <- nil
-			errors <- fmt.Errorf("reader misaligned")
-			return
-		}
-	}
-}
-
-func write_from_channel(writer io.Writer, size int64, channel chan []byte, progress chan int, errors chan error) {
-	total := int64(0)
-	for {
-		chunk := <-channel
-
-		if chunk == nil {
-			progress <- -1
-			errors <- fmt.Errorf("link terminated")
-			return
-		}
+//set by the daemon, everything shown goes to its log instead
+var logger log_sink
 
-		err := write_from_buffer(writer, chunk)
-		if err != nil {
-			progress <- -1
-			errors <- err
-			return
-		}
-		progress <- len(chunk)
-
-		total += int64(len(chunk))
-		if total == size {
-			progress <- 0
-			return
-		}
-
-		if total > size {
-			progress <- -1
-			errors <- fmt.Errorf("channel misaligned")
-			return
-		}
-	}
-}
-
-func open_file_for_writing(path string) (*bufio.Writer, error) {
-	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
-	if err != nil {
-		return nil, err
-	}
-
-	f, err := os.Create(path)
-	if err != nil {
-		return nil, err
-	}
-
-	writer := bufio.NewWriter(f)
-
-	return writer, nil
-}
-
-func open_file_for_reading(path string) (*bufio.Reader, error) {
-	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
-	if err != nil {
-		return nil, err
-	}
-
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-
-	reader := bufio.NewReader(f)
-
-	return reader, nil
-}
-
-func expand_path(path string) []string {
-	//expand wildcards in the arguments etc
-	out := make([]string, 0)
-
-	matches, err := filepath.Glob(path)
-	if err != nil || len(matches) == 0 {
-		out = append(out, path)
-	} else {
-		out = append(out, matches...)
-	}
-
-	return out
-}
-
-func format_elapsed(ms float64) string {
-	if ms < 1.0 {
-		return fmt.Sprintf("%.3fms", ms)
-	} else if ms < 1000.0 {
-		return fmt.Sprintf("%.1fms", ms)
-	} else if ms < 60000.0 {
-		return fmt.Sprintf("%.3fs", ms/1000.0)
-	} else {
-		return fmt.Sprintf("%.3fm", ms/60000.0)
+func color(code string) {
+	if colors {
+		fmt.Print(code)
 	}
 }
 
 func set_timing_color(ms float64) {
 	if ms <= 0.2 {
-		fmt.Print("\033[38;5;213m")
+		color("\033[38;5;213m")
 	} else if ms < 1.0 {
-		fmt.Print("\033[38;5;177m")
+		color("\033[38;5;177m")
 	} else if ms < 1000.0 {
-		fmt.Print("\033[38;5;141m")
+		color("\033[38;5;141m")
 	} else if ms < 60000.0 {
-		fmt.Print("\033[38;5;69m")
+		color("\033[38;5;69m")
 	} else {
-		fmt.Print("\033[38;5;33m")
+		color("\033[38;5;33m")
 	}
 }
 
@@ -185,37 +36,63 @@ func set_progress_color(progress float64) {
 	stage := int(progress * 5.99)
 	switch stage {
 	case 0:
-		fmt.Print("\033[38;5;220m")
+		color("\033[38;5;220m")
 	case 1:
-		fmt.Print("\033[38;5;184m")
+		color("\033[38;5;184m")
 	case 2:
-		fmt.Print("\033[38;5;148m")
+		color("\033[38;5;148m")
 	case 3:
-		fmt.Print("\033[38;5;112m")
+		color("\033[38;5;112m")
 	case 4:
-		fmt.Print("\033[38;5;76m")
+		color("\033[38;5;76m")
 	case 5:
-		fmt.Print("\033[38;5;40m")
+		color("\033[38;5;40m")
 	}
 }
 
 func reset_color() {
-	fmt.Print("\033[0m")
+	color("\033[0m")
 }
 
 func error_color() {
-	fmt.Print("\033[38;5;160m")
+	color("\033[38;5;160m")
 }
 
 func title_color() {
-	fmt.Print("\033[38;5;21m")
+	color("\033[38;5;21m")
 }
 
 func info_color() {
-	fmt.Print("\033[38;5;220m")
+	color("\033[38;5;220m")
 }
 
 func show_error(err error, msg string) {
+	if logger != nil {
+		if msg != "" {
+			logger.Err(msg)
+		}
+		if err != nil {
+			logger.Err(err.Error())
+		}
+		return
+	}
+
+	if output == OUTPUT_JSON {
+		//keep stdout clean for the event stream
+		if msg != "" {
+			fmt.Fprintln(os.Stderr, msg)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+		return
+	}
+
+	//make room above any progress rows, theyre redrawn on the next update
+	guard.Lock()
+	defer guard.Unlock()
+	clear_rows()
+
 	error_color()
 	if msg != "" {
 		fmt.Printf("%s\n", msg)
@@ -226,14 +103,50 @@ func show_error(err error, msg string) {
 	reset_color()
 }
 
+func show_verbose(info string) {
+	if verbosity >= VERBOSITY_VERBOSE {
+		show_info(info)
+	}
+}
+
 func show_info(info string) {
+	if verbosity == VERBOSITY_QUIET {
+		return
+	}
+
+	if logger != nil {
+		logger.Info(info)
+		return
+	}
+
+	if output == OUTPUT_JSON {
+		fmt.Fprintln(os.Stderr, info)
+		return
+	}
+
+	guard.Lock()
+	defer guard.Unlock()
+	clear_rows()
+
 	info_color()
 	fmt.Println(info)
 	reset_color()
 }
 
+func restore_terminal() {
+	//leave the cursor on a clean line with the default colors
+	guard.Lock()
+	defer guard.Unlock()
+
+	if prompting {
+		fmt.Println()
+	}
+	clear_rows()
+	reset_color()
+}
+
 func help() {
-	show_info("wire r\n\treceive mode\nwire s PATH\n\tsend PATH/s\nwire wr OR wire ws\n\twireless modes\nwire i\n\tinstall\nwire u\n\tuninstall")
+	show_info("wire r [--share] [--auto-accept] [--trust PEERS] [--max-bytes N] [--max-files N] [--fsync] [--limit RATE] [--once] [--resume-wait D] [--timeout D] [--json] [-q] [-v] PATH\n\treceive mode, asks before accepting each session\nwire s [--keep-going] [--move] [--exclude PATTERN] [--include PATTERN] [--exclude-from FILE] [--gitignore] [--dry-run] [--files-from LIST] [-0] [--base DIR] [--flatten] [--prefix DIR] [--strip-components N] [--limit RATE] [--retries N] [--backoff D] [--json] [-q] [-v] PATH[:DEST]\n\tsend PATH/s\nwire ls [--json] [PEER:]PATH\n\tlist PATH on a peer receiving with --share\nwire daemon [--config FILE] [--log FILE|syslog] [--foreground]\n\treceive in the background\nwire status [--json] OR wire stop\n\tquery or stop the daemon\nwire wr OR wire ws OR wire wls\n\twireless modes\nwire i [--service]\n\tinstall, --service also runs the daemon at login on linux\nwire u\n\tuninstall")
 }
 
 func copy_file(source, destination string) error {
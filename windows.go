@@ -6,16 +6,20 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"syscall"
 
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 )
 
-func get_time() int64 {
-	var t windows.Filetime
-	windows.GetSystemTimePreciseAsFileTime(&t)
-	return t.Nanoseconds()
+func terminal_width() int {
+	var info windows.ConsoleScreenBufferInfo
+	if err := windows.GetConsoleScreenBufferInfo(windows.Handle(os.Stdout.Fd()), &info); err != nil {
+		return 80
+	}
+	return int(info.Window.Right-info.Window.Left) + 1
 }
 
 func init() {
@@ -177,7 +181,11 @@ func terminate() {
 	os.Exit(1)
 }
 
-func install(self string) {
+func install(self string, service bool) {
+	if service {
+		show_error(nil, "--service is only available on linux, use wire daemon instead")
+		return
+	}
 	if err := install_to_appdata(self); err != nil {
 		show_error(err, "failed to install")
 		return
@@ -201,3 +209,17 @@ func uninstall() {
 	}
 	show_info("wire uninstalled")
 }
+
+func limit_signals() (slower, faster os.Signal) {
+	//theres nothing to send a running process here
+	return nil, nil
+}
+
+func detach(cmd *exec.Cmd) {
+	//no console, and ctrl-c in the one that started it doesnt reach it
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: windows.DETACHED_PROCESS | windows.CREATE_NEW_PROCESS_GROUP}
+}
+
+func open_syslog() (log_sink, error) {
+	return nil, fmt.Errorf("syslog isnt available on windows, log to a file instead")
+}